@@ -0,0 +1,87 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+
+	log "github.com/golang/glog"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// backoff produces the delays between retries, starting at initial and growing by factor up to
+// max. Each delay is randomly adjusted by up to ±jitter, as a fraction of the delay, so that
+// retries from many instances don't line up.
+type backoff struct {
+	factor float64
+	max    time.Duration
+	jitter float64
+
+	next time.Duration
+	rnd  *rand.Rand
+}
+
+func newBackoff(initial time.Duration, factor float64, max time.Duration, jitter float64) *backoff {
+	if initial > max {
+		initial = max
+	}
+	return &backoff{
+		factor: factor,
+		max:    max,
+		jitter: jitter,
+		next:   initial,
+		rnd:    rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// validateBackoff returns an error if backoffs from these options wouldn't grow from a positive
+// delay, which would retry in a hot loop
+func validateBackoff(initial time.Duration, factor float64, max time.Duration, jitter float64) error {
+	switch {
+	case initial <= 0:
+		return errors.Errorf("initial backoff must be positive, not %v", initial)
+	case factor < 1:
+		return errors.Errorf("backoff factor must be at least 1, not %v", factor)
+	case max <= 0:
+		return errors.Errorf("max backoff must be positive, not %v", max)
+	case jitter < 0 || jitter > 1:
+		return errors.Errorf("backoff jitter must be from 0 to 1, not %v", jitter)
+	}
+	return nil
+}
+
+// flagBackoff returns a backoff using the -retry flags, capped at max
+func flagBackoff(max time.Duration) *backoff {
+	return newBackoff(backoffInitial, backoffFactor, max, backoffJitter)
+}
+
+// Next returns the delay before the next retry, which is never more than max
+func (b *backoff) Next() time.Duration {
+	d := b.next
+	b.next = time.Duration(float64(b.next) * b.factor)
+	if b.next > b.max {
+		b.next = b.max
+	}
+
+	if b.jitter > 0 {
+		d = jitteredInterval(b.rnd, d, time.Duration(float64(d)*b.jitter))
+		if d > b.max {
+			d = b.max
+		}
+	}
+	return d
+}
+
+// Wait sleeps for the next delay, returning the context's error early if it is done first
+func (b *backoff) Wait(ctx context.Context) error {
+	d := b.Next()
+	log.V(2).Infof("Backing off for %v", d)
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
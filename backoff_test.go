@@ -0,0 +1,106 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestBackoffNext(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name     string
+		b        *backoff
+		expected []time.Duration
+	}{
+		{
+			name:     "doubling",
+			b:        newBackoff(time.Second, 2, 10*time.Second, 0),
+			expected: []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second},
+		},
+		{
+			name:     "constant",
+			b:        newBackoff(time.Second, 1, 10*time.Second, 0),
+			expected: []time.Duration{time.Second, time.Second, time.Second},
+		},
+		{
+			name:     "initial over max",
+			b:        newBackoff(time.Minute, 2, 10*time.Second, 0),
+			expected: []time.Duration{10 * time.Second, 10 * time.Second},
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+
+			for i, e := range c.expected {
+				if d := c.b.Next(); d != e {
+					t.Fatalf("Difference in delay %d\nGot: %v\nExpected: %v\n", i, d, e)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateBackoff(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name    string
+		initial time.Duration
+		factor  float64
+		max     time.Duration
+		jitter  float64
+		valid   bool
+	}{
+		{name: "defaults", initial: time.Second, factor: 1.1, max: 10 * time.Second, valid: true},
+		{name: "constant", initial: time.Second, factor: 1, max: time.Second, jitter: 1, valid: true},
+		{name: "no initial", initial: 0, factor: 2, max: 10 * time.Second},
+		{name: "shrinking", initial: time.Second, factor: 0.5, max: 10 * time.Second},
+		{name: "no max", initial: time.Second, factor: 2, max: 0},
+		{name: "negative jitter", initial: time.Second, factor: 2, max: 10 * time.Second, jitter: -0.1},
+		{name: "large jitter", initial: time.Second, factor: 2, max: 10 * time.Second, jitter: 1.5},
+	}
+	for _, c := range cases {
+		err := validateBackoff(c.initial, c.factor, c.max, c.jitter)
+		if c.valid && err != nil {
+			t.Errorf("%v: expected valid, got %v", c.name, err)
+		}
+		if !c.valid && err == nil {
+			t.Errorf("%v: expected an error", c.name)
+		}
+	}
+}
+
+func TestBackoffJitter(t *testing.T) {
+	t.Parallel()
+
+	for i := 0; i < 1000; i++ {
+		b := newBackoff(4*time.Second, 2, 10*time.Second, 0.5)
+		if d := b.Next(); d < 2*time.Second || d > 6*time.Second {
+			t.Fatalf("First delay %v outside of 4s ± 2s", d)
+		}
+		b.Next()
+		if d := b.Next(); d < 5*time.Second || d > 10*time.Second {
+			t.Fatalf("Capped delay %v outside of 5s to 10s", d)
+		}
+	}
+}
+
+func TestBackoffWaitCancelled(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	started := time.Now()
+	if err := newBackoff(time.Hour, 2, time.Hour, 0).Wait(ctx); err != context.Canceled {
+		t.Fatalf("Expected %v from a cancelled context, got %v", context.Canceled, err)
+	}
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Fatalf("Expected a prompt return after cancelling, took %v", elapsed)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		a, b string
+		want string
+	}{
+		{
+			name: "unchanged",
+			a:    "a\nb\n",
+			b:    "a\nb\n",
+			want: "",
+		},
+		{
+			name: "new file",
+			a:    "",
+			b:    "a\nb\n",
+			want: "--- old\n+++ new\n@@ -0,0 +1,2 @@\n+a\n+b\n",
+		},
+		{
+			name: "changed line",
+			a:    "1\n2\n3\n4\n5\n6\n7\n8\n",
+			b:    "1\n2\n3\n4\nfive\n6\n7\n8\n",
+			want: "--- old\n+++ new\n@@ -2,7 +2,7 @@\n 2\n 3\n 4\n-5\n+five\n 6\n 7\n 8\n",
+		},
+		{
+			name: "separate hunks",
+			a:    "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n",
+			b:    "one\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n13\n",
+			want: "--- old\n+++ new\n@@ -1,4 +1,4 @@\n-1\n+one\n 2\n 3\n 4\n@@ -10,3 +10,4 @@\n 10\n 11\n 12\n+13\n",
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			got := unifiedDiff("old", "new", []byte(tt.a), []byte(tt.b))
+			if got != tt.want {
+				t.Fatalf("Expected diff\n%s\nGot\n%s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestDiffLinesBeyondTable(t *testing.T) {
+	t.Parallel()
+
+	// Interleaved changes leave little common prefix or suffix to trim, so the middle is too large
+	// to find the smallest diff for and is shown as removed then added
+	a, b := []string{}, []string{}
+	for i := 0; i < 1100; i++ {
+		a = append(a, fmt.Sprintf("a%d", i), "same")
+		b = append(b, fmt.Sprintf("b%d", i), "same")
+	}
+	// The last line is common, so is kept
+	ops := diffLines(a, b)
+	if len(ops) != len(a)+len(b)-1 {
+		t.Fatalf("Expected %d removed, added and kept lines, got %d ops", len(a)+len(b)-1, len(ops))
+	}
+	for i, op := range ops {
+		want := byte('-')
+		switch {
+		case i == len(ops)-1:
+			want = ' '
+		case i >= len(a)-1:
+			want = '+'
+		}
+		if op.kind != want {
+			t.Fatalf("Expected op %d to be %c, got %c %v", i, want, op.kind, op.line)
+		}
+	}
+}
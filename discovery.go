@@ -0,0 +1,451 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+
+	log "github.com/golang/glog"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+
+	compute "google.golang.org/api/compute/v1"
+	container "google.golang.org/api/container/v1"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+)
+
+// ClusterLister lists the zones of a project, and the clusters within them
+type ClusterLister interface {
+	ListZones(ctx context.Context, project string) ([]string, error)
+	ListClusters(ctx context.Context, project, zone string) ([]*container.Cluster, error)
+	GetCluster(ctx context.Context, project, location, name string) (*container.Cluster, error)
+}
+
+// gcpClusterLister lists zones and clusters with the GCP apis
+type gcpClusterLister struct {
+	compute   *compute.Service
+	container *container.Service
+}
+
+func newGCPClusterLister(ctx context.Context) (*gcpClusterLister, error) {
+	opts := []option.ClientOption{
+		option.WithScopes(container.CloudPlatformScope, compute.ComputeReadonlyScope),
+		option.WithUserAgent(gcpUserAgent),
+	}
+	computeOpts := append([]option.ClientOption{}, opts...)
+	if gcpComputeEndpoint != "" {
+		computeOpts = append(computeOpts, option.WithEndpoint(gcpComputeEndpoint))
+	}
+	containerOpts := append([]option.ClientOption{}, opts...)
+	if gcpContainerEndpoint != "" {
+		containerOpts = append(containerOpts, option.WithEndpoint(gcpContainerEndpoint))
+	}
+
+	computeSvc, err := compute.NewService(ctx, computeOpts...)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create compute service")
+	}
+	containerSvc, err := container.NewService(ctx, containerOpts...)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create container service")
+	}
+	return &gcpClusterLister{compute: computeSvc, container: containerSvc}, nil
+}
+
+func (l *gcpClusterLister) ListZones(ctx context.Context, project string) ([]string, error) {
+	zones := []string{}
+	err := l.compute.Zones.List(project).Pages(ctx, func(page *compute.ZoneList) error {
+		for _, z := range page.Items {
+			zones = append(zones, z.Name)
+		}
+		return nil
+	})
+	if err != nil {
+		return []string{}, errors.Wrap(err, "could not list zones")
+	}
+	return zones, nil
+}
+
+func (l *gcpClusterLister) ListClusters(ctx context.Context, project, zone string) ([]*container.Cluster, error) {
+	res, err := l.container.Projects.Zones.Clusters.List(project, zone).Context(ctx).Do()
+	if err != nil {
+		return []*container.Cluster{}, errors.Wrap(err, "could not list clusters")
+	}
+	return res.Clusters, nil
+}
+
+func (l *gcpClusterLister) GetCluster(ctx context.Context, project, location, name string) (*container.Cluster, error) {
+	path := fmt.Sprintf("projects/%v/locations/%v/clusters/%v", project, location, name)
+	c, err := l.container.Projects.Locations.Clusters.Get(path).Context(ctx).Do()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not get cluster")
+	}
+	return c, nil
+}
+
+// clusterRef names a single cluster
+type clusterRef struct {
+	Project  string
+	Location string
+	Name     string
+}
+
+func (r clusterRef) String() string {
+	return fmt.Sprintf("%v/%v/%v", r.Project, r.Location, r.Name)
+}
+
+// parseClusterRef parses a cluster given as project/location/name
+func parseClusterRef(s string) (clusterRef, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return clusterRef{}, errors.Errorf("cluster %q must be given as project/location/name", s)
+	}
+	return clusterRef{Project: parts[0], Location: parts[1], Name: parts[2]}, nil
+}
+
+// findClusters lists the clusters in every zone of project, skipping those without an endpoint
+// and those filtered out by the discovery flags. If clusters are pinned with -gcp.clusters just
+// those are fetched instead, and aren't filtered.
+func findClusters(ctx context.Context, lister ClusterLister, project string) ([]*container.Cluster, error) {
+	if len(pinnedClusters) > 0 {
+		clusters, err := getClusters(ctx, lister, pinnedClusters)
+		return qualifyClusterNames(clusters), err
+	}
+
+	err := opsLimit.Acquire(ctx)
+	if err != nil {
+		return []*container.Cluster{}, err
+	}
+	zones, err := lister.ListZones(ctx, project)
+	opsLimit.Release()
+	if err != nil {
+		discoveryErrors.WithLabelValues(project, discoveryErrorReason(err)).Inc()
+		return []*container.Cluster{}, errors.Wrap(err, "could not list zones")
+	}
+
+	// Zones are listed concurrently, but their clusters are gathered in zone order
+	zoneClusters := make([][]*container.Cluster, len(zones))
+	errs := forEachLimited(ctx, opsLimit, len(zones), func(i int) error {
+		var err error
+		zoneClusters[i], err = lister.ListClusters(ctx, project, zones[i])
+		return err
+	})
+	clusters := []*container.Cluster{}
+	for i, z := range zones {
+		zcs, err := zoneClusters[i], errs[i]
+		if err != nil {
+			reason := discoveryErrorReason(err)
+			discoveryErrors.WithLabelValues(project, reason).Inc()
+			if failOnPartial || reason != "permission" {
+				return []*container.Cluster{}, errors.Wrapf(err, "could not list clusters in %v/%v", project, z)
+			}
+			// A zone we can't see shouldn't cost us the clusters in every other zone
+			log.Warningf("Skipping %v/%v: %v", project, z, err)
+			continue
+		}
+		for _, c := range zcs {
+			if c.Endpoint != "" {
+				clusters = append(clusters, c)
+			} else {
+				log.V(2).Infof("Could not get endpoint for cluster: %v", c.Name)
+			}
+		}
+	}
+	clusters = dedupeClusters(project, clusters)
+	if len(releaseChannels) > 0 {
+		clusters = filterReleaseChannels(clusters, releaseChannels)
+	}
+	if clusterNetwork != "" || clusterSubnetwork != "" {
+		clusters = filterNetwork(clusters, clusterNetwork, clusterSubnetwork)
+	}
+	if !discoverAllClusters && clusterLabel != "" {
+		clusters = filterClusterLabel(clusters, clusterLabel)
+	}
+	return qualifyClusterNames(clusters), nil
+}
+
+// findClustersRetrying calls findClusters, retrying with b until it succeeds or ctx is done.
+// Permission and not found errors aren't retried, as they won't go away by themselves.
+func findClustersRetrying(ctx context.Context, lister ClusterLister, project string, b *backoff) ([]*container.Cluster, error) {
+	for {
+		clusters, err := findClusters(ctx, lister, project)
+		if err == nil {
+			return clusters, nil
+		}
+		if reason := discoveryErrorReason(err); reason == "permission" || reason == "not_found" {
+			return clusters, err
+		}
+		log.Warningf("Failed to find clusters, retrying: %v", err)
+		if b.Wait(ctx) != nil {
+			return clusters, err
+		}
+	}
+}
+
+// getClusters fetches each of the clusters named by refs, skipping those without an endpoint
+func getClusters(ctx context.Context, lister ClusterLister, refs []string) ([]*container.Cluster, error) {
+	parsed := make([]clusterRef, len(refs))
+	for i, s := range refs {
+		ref, err := parseClusterRef(s)
+		if err != nil {
+			return []*container.Cluster{}, err
+		}
+		parsed[i] = ref
+	}
+
+	got := make([]*container.Cluster, len(parsed))
+	errs := forEachLimited(ctx, opsLimit, len(parsed), func(i int) error {
+		var err error
+		got[i], err = lister.GetCluster(ctx, parsed[i].Project, parsed[i].Location, parsed[i].Name)
+		return err
+	})
+	clusters := []*container.Cluster{}
+	for i, ref := range parsed {
+		c, err := got[i], errs[i]
+		if err != nil {
+			reason := discoveryErrorReason(err)
+			discoveryErrors.WithLabelValues(ref.Project, reason).Inc()
+			if reason == "not_found" {
+				return []*container.Cluster{}, errors.Wrapf(err, "cluster %v does not exist", ref)
+			}
+			return []*container.Cluster{}, errors.Wrapf(err, "could not get cluster %v", ref)
+		}
+		if c.Endpoint == "" {
+			log.V(2).Infof("Could not get endpoint for cluster: %v", ref)
+			continue
+		}
+		clusters = append(clusters, c)
+	}
+	return clusters, nil
+}
+
+// findProjectsClusters finds the clusters in each of projects. The names of clusters in projects
+// other than the first are prefixed with their project, so that the certs and jobs of clusters
+// with the same name in different projects don't collide, however many projects there are.
+// Projects we don't have permission to list are skipped, unless -fail-on-partial is set.
+func findProjectsClusters(ctx context.Context, lister ClusterLister, projects []string, b *backoff) ([]*container.Cluster, error) {
+	// Pinned clusters name their own projects
+	if len(pinnedClusters) > 0 {
+		pcs, err := findClustersRetrying(ctx, lister, projects[0], b)
+		clusters := make([]*container.Cluster, 0, len(pcs))
+		for _, c := range pcs {
+			if p := selfLinkProject(c.SelfLink); p != "" && p != projects[0] {
+				// Copied, as the lister may hand out the same cluster again
+				pc := *c
+				pc.Name = projectClusterName(p, c.Name)
+				c = &pc
+			}
+			clusters = append(clusters, c)
+		}
+		return clusters, err
+	}
+
+	clusters := []*container.Cluster{}
+	for i, p := range projects {
+		pcs, err := findClustersRetrying(ctx, lister, p, b)
+		if err != nil {
+			if failOnPartial || discoveryErrorReason(err) != "permission" {
+				return []*container.Cluster{}, errors.Wrapf(err, "could not find clusters in project %v", p)
+			}
+			log.Warningf("Skipping project %v: %v", p, err)
+			continue
+		}
+		for _, c := range pcs {
+			if i > 0 {
+				// Copied, as the lister may hand out the same cluster again
+				pc := *c
+				pc.Name = projectClusterName(p, c.Name)
+				c = &pc
+			}
+			clusters = append(clusters, c)
+		}
+	}
+	return clusters, nil
+}
+
+// projectClusterName returns the name of a cluster prefixed with its project
+func projectClusterName(project, name string) string {
+	return project + "_" + name
+}
+
+// selfLinkProject returns the project in a GCP self link, or an empty string if there isn't one
+func selfLinkProject(selfLink string) string {
+	parts := strings.Split(selfLink, "/")
+	for i := 0; i < len(parts)-1; i++ {
+		if parts[i] == "projects" {
+			return parts[i+1]
+		}
+	}
+	return ""
+}
+
+// filterClusterLabel keeps only clusters with the GCP label given as key=value, or just key to
+// accept any value
+func filterClusterLabel(clusters []*container.Cluster, label string) []*container.Cluster {
+	kv := strings.SplitN(label, "=", 2)
+	filtered := make([]*container.Cluster, 0, len(clusters))
+	for _, c := range clusters {
+		v, ok := c.ResourceLabels[kv[0]]
+		if !ok || (len(kv) == 2 && v != kv[1]) {
+			log.V(2).Infof("Ignoring cluster %v without label %v", c.Name, label)
+			continue
+		}
+		filtered = append(filtered, c)
+	}
+	return filtered
+}
+
+// filterReleaseChannels keeps only clusters on one of channels. Clusters not enrolled in a
+// release channel are kept only if channels contains "static".
+func filterReleaseChannels(clusters []*container.Cluster, channels []string) []*container.Cluster {
+	filtered := make([]*container.Cluster, 0, len(clusters))
+	for _, c := range clusters {
+		channel := "static"
+		if c.ReleaseChannel != nil && c.ReleaseChannel.Channel != "" && c.ReleaseChannel.Channel != "UNSPECIFIED" {
+			channel = c.ReleaseChannel.Channel
+		}
+		keep := false
+		for _, ch := range channels {
+			if strings.EqualFold(ch, channel) {
+				keep = true
+				break
+			}
+		}
+		if !keep {
+			log.V(2).Infof("Ignoring cluster %v on release channel %v", c.Name, channel)
+			continue
+		}
+		filtered = append(filtered, c)
+	}
+	return filtered
+}
+
+// filterNetwork keeps only clusters on network and subnetwork, either of which may be empty to
+// accept any. Networks may be given by name or by resource path.
+func filterNetwork(clusters []*container.Cluster, network, subnetwork string) []*container.Cluster {
+	filtered := make([]*container.Cluster, 0, len(clusters))
+	for _, c := range clusters {
+		if network != "" && path.Base(c.Network) != path.Base(network) {
+			log.V(2).Infof("Ignoring cluster %v on network %v", c.Name, c.Network)
+			continue
+		}
+		if subnetwork != "" && path.Base(c.Subnetwork) != path.Base(subnetwork) {
+			log.V(2).Infof("Ignoring cluster %v on subnetwork %v", c.Name, c.Subnetwork)
+			continue
+		}
+		filtered = append(filtered, c)
+	}
+	return filtered
+}
+
+// quotaReasons are the googleapi error reasons that GCP returns with a 403 when a quota or rate
+// limit, rather than a permission, is the problem
+var quotaReasons = map[string]bool{
+	"quotaExceeded":         true,
+	"rateLimitExceeded":     true,
+	"userRateLimitExceeded": true,
+}
+
+// discoveryErrorReason classifies an error from listing zones or getting clusters as one of quota,
+// permission, not_found, network or other
+func discoveryErrorReason(err error) string {
+	switch cause := errors.Cause(err).(type) {
+	case *googleapi.Error:
+		switch cause.Code {
+		case http.StatusTooManyRequests:
+			return "quota"
+		case http.StatusUnauthorized, http.StatusForbidden:
+			for _, e := range cause.Errors {
+				if quotaReasons[e.Reason] {
+					return "quota"
+				}
+			}
+			return "permission"
+		case http.StatusNotFound:
+			return "not_found"
+		}
+	case net.Error:
+		return "network"
+	}
+	return "other"
+}
+
+// dedupeClusters removes clusters listed more than once, as can happen when overlapping
+// locations are queried, keeping the first occurrence
+func dedupeClusters(project string, clusters []*container.Cluster) []*container.Cluster {
+	seen := map[string]bool{}
+	deduped := make([]*container.Cluster, 0, len(clusters))
+	for _, c := range clusters {
+		key := fmt.Sprintf("%v/%v/%v", project, clusterLocation(c), c.Name)
+		if seen[key] {
+			log.V(2).Infof("Ignoring duplicate cluster %v", key)
+			continue
+		}
+		seen[key] = true
+		deduped = append(deduped, c)
+	}
+	return deduped
+}
+
+// qualifyClusterNames prefixes the name of every cluster with its location, as names are only
+// unique within a location. Every cluster is named the same way, so a cluster of the same name
+// coming or going elsewhere doesn't rename the certs, jobs and labels of the others.
+func qualifyClusterNames(clusters []*container.Cluster) []*container.Cluster {
+	qualified := make([]*container.Cluster, 0, len(clusters))
+	for _, c := range clusters {
+		if location := clusterLocation(c); location != "" {
+			// Copied, as the lister may hand out the same cluster again
+			qc := *c
+			qc.Name = location + "_" + c.Name
+			c = &qc
+		}
+		qualified = append(qualified, c)
+	}
+	return qualified
+}
+
+// clusterKey identifies a cluster by its self link, which unlike its name is unique across
+// projects and locations, falling back to its name for clusters without one
+func clusterKey(c *container.Cluster) string {
+	if c.SelfLink != "" {
+		return c.SelfLink
+	}
+	return c.Name
+}
+
+// clusterLocation returns the zone or region of a cluster
+func clusterLocation(c *container.Cluster) string {
+	if c.Location != "" {
+		return c.Location
+	}
+	return c.Zone
+}
+
+// unstableStatuses are the cluster statuses during which the endpoint and certs may be in flux
+var unstableStatuses = map[string]bool{
+	"RECONCILING": true,
+	"DEGRADED":    true,
+}
+
+// holdUnstableClusters replaces clusters that are being reconciled or are degraded with their
+// previously discovered version, so maintenance doesn't churn certs and reloads. Clusters with
+// no previous version are kept as discovered.
+func holdUnstableClusters(previous, clusters []*container.Cluster) []*container.Cluster {
+	previousByKey := map[string]*container.Cluster{}
+	for _, c := range previous {
+		previousByKey[clusterKey(c)] = c
+	}
+
+	held := make([]*container.Cluster, 0, len(clusters))
+	for _, c := range clusters {
+		if p, ok := previousByKey[clusterKey(c)]; ok && unstableStatuses[c.Status] {
+			log.Infof("Holding steady for cluster %v while it is %v", c.Name, c.Status)
+			c = p
+		}
+		held = append(held, c)
+	}
+	return held
+}
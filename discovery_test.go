@@ -0,0 +1,450 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	compute "google.golang.org/api/compute/v1"
+	container "google.golang.org/api/container/v1"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+)
+
+// fakeClusterLister serves zones and clusters from memory
+type fakeClusterLister struct {
+	zones    []string
+	zonesErr error
+	clusters map[string][]*container.Cluster
+	errs     map[string]error
+}
+
+func (l *fakeClusterLister) ListZones(ctx context.Context, project string) ([]string, error) {
+	return l.zones, l.zonesErr
+}
+
+func (l *fakeClusterLister) ListClusters(ctx context.Context, project, zone string) ([]*container.Cluster, error) {
+	return l.clusters[zone], l.errs[zone]
+}
+
+func (l *fakeClusterLister) GetCluster(ctx context.Context, project, location, name string) (*container.Cluster, error) {
+	for _, c := range l.clusters[location] {
+		if c.Name == name {
+			return c, nil
+		}
+	}
+	return nil, &googleapi.Error{Code: http.StatusNotFound}
+}
+
+func clusterNames(clusters []*container.Cluster) []string {
+	names := []string{}
+	for _, c := range clusters {
+		names = append(names, c.Name)
+	}
+	return names
+}
+
+// TestFindClusters isn't parallel as it sets the discovery flags
+func TestFindClusters(t *testing.T) {
+	defer func(all bool, label string, channels stringSliceFlag, partial bool) {
+		discoverAllClusters, clusterLabel, releaseChannels, failOnPartial = all, label, channels, partial
+	}(discoverAllClusters, clusterLabel, releaseChannels, failOnPartial)
+
+	optedIn := map[string]string{"prometheus-scrape": "true"}
+	lister := &fakeClusterLister{
+		zones: []string{"europe-west1-b", "europe-west1-c", "us-east1-b"},
+		clusters: map[string][]*container.Cluster{
+			"europe-west1-b": {
+				{Name: "a", Endpoint: "10.0.0.1", Zone: "europe-west1-b", ResourceLabels: optedIn},
+				{Name: "provisioning", Zone: "europe-west1-b", ResourceLabels: optedIn},
+			},
+			"europe-west1-c": {
+				{Name: "b", Endpoint: "10.0.0.2", Zone: "europe-west1-c", ReleaseChannel: &container.ReleaseChannel{Channel: "RAPID"}},
+			},
+		},
+		errs: map[string]error{
+			"us-east1-b": &googleapi.Error{Code: http.StatusForbidden},
+		},
+	}
+
+	cases := []struct {
+		name     string
+		all      bool
+		label    string
+		channels stringSliceFlag
+		partial  bool
+		expected []string
+		valid    bool
+	}{
+		{name: "opted in", label: "prometheus-scrape=true", expected: []string{"europe-west1-b_a"}, valid: true},
+		{name: "no label", expected: []string{"europe-west1-b_a", "europe-west1-c_b"}, valid: true},
+		{name: "all", all: true, label: "prometheus-scrape=true", expected: []string{"europe-west1-b_a", "europe-west1-c_b"}, valid: true},
+		{name: "channels", all: true, channels: stringSliceFlag{"rapid"}, expected: []string{"europe-west1-c_b"}, valid: true},
+		{name: "fail on partial", all: true, partial: true, valid: false},
+	}
+
+	for _, c := range cases {
+		discoverAllClusters, clusterLabel, releaseChannels, failOnPartial = c.all, c.label, c.channels, c.partial
+		clusters, err := findClusters(context.Background(), lister, "project")
+		if (err == nil) != c.valid {
+			t.Fatalf("%v: difference in expected validity\nGot: %v\nExpected valid: %v\n", c.name, err, c.valid)
+		}
+		if c.valid && !reflect.DeepEqual(clusterNames(clusters), c.expected) {
+			t.Fatalf("%v: difference in expected clusters\nGot: %v\nExpected: %v\n", c.name, clusterNames(clusters), c.expected)
+		}
+	}
+
+	lister.zonesErr = errors.New("connection refused")
+	if _, err := findClusters(context.Background(), lister, "project"); err == nil {
+		t.Fatalf("Expected an error when zones can't be listed")
+	}
+}
+
+// TestFindClustersSameName isn't parallel as it sets the discovery flags
+func TestFindClustersSameName(t *testing.T) {
+	defer func(all bool) { discoverAllClusters = all }(discoverAllClusters)
+	discoverAllClusters = true
+
+	lister := &fakeClusterLister{
+		zones: []string{"europe-west1-b", "us-east1-b"},
+		clusters: map[string][]*container.Cluster{
+			"europe-west1-b": {{Name: "prod", Endpoint: "10.0.0.1", Zone: "europe-west1-b"}, {Name: "dev", Endpoint: "10.0.0.2", Zone: "europe-west1-b"}},
+			"us-east1-b":     {{Name: "prod", Endpoint: "10.1.0.1", Zone: "us-east1-b"}},
+		},
+	}
+	clusters, err := findClusters(context.Background(), lister, "project")
+	if err != nil {
+		t.Fatalf("Could not find clusters: %v", err)
+	}
+	expected := []string{"europe-west1-b_prod", "europe-west1-b_dev", "us-east1-b_prod"}
+	if !reflect.DeepEqual(clusterNames(clusters), expected) {
+		t.Fatalf("Expected names to be prefixed with their location\nGot: %v\nExpected: %v", clusterNames(clusters), expected)
+	}
+	if lister.clusters["us-east1-b"][0].Name != "prod" {
+		t.Fatalf("Expected the listed cluster to be left unmodified")
+	}
+
+	// A cluster of the same name going away doesn't rename the other
+	lister.clusters["us-east1-b"] = nil
+	clusters, err = findClusters(context.Background(), lister, "project")
+	if err != nil {
+		t.Fatalf("Could not find clusters: %v", err)
+	}
+	expected = []string{"europe-west1-b_prod", "europe-west1-b_dev"}
+	if !reflect.DeepEqual(clusterNames(clusters), expected) {
+		t.Fatalf("Expected names to stay the same\nGot: %v\nExpected: %v", clusterNames(clusters), expected)
+	}
+
+	for _, c := range clusters {
+		c.MasterAuth = &container.MasterAuth{}
+	}
+	if _, err := buildConfig(PrometheusConfig{}, testConfigOptions(), builtinRoles(), clusters); err != nil {
+		t.Fatalf("Expected distinct jobs for the same named clusters: %v", err)
+	}
+}
+
+// TestFindProjectsClusters isn't parallel as it sets the discovery flags
+func TestFindProjectsClusters(t *testing.T) {
+	defer func(all, partial bool) {
+		discoverAllClusters, failOnPartial = all, partial
+	}(discoverAllClusters, failOnPartial)
+	discoverAllClusters = true
+
+	lister := &projectsClusterLister{
+		"host": {
+			zones:    []string{"europe-west1-b"},
+			clusters: map[string][]*container.Cluster{"europe-west1-b": {{Name: "shared", Endpoint: "10.0.0.1"}}},
+		},
+		"service-a": {
+			zones:    []string{"europe-west1-b"},
+			clusters: map[string][]*container.Cluster{"europe-west1-b": {{Name: "prod", Endpoint: "10.0.1.1"}}},
+		},
+		"service-b": {
+			zones:    []string{"europe-west1-b"},
+			clusters: map[string][]*container.Cluster{"europe-west1-b": {{Name: "prod", Endpoint: "10.0.2.1"}}},
+		},
+		"forbidden": {
+			zonesErr: &googleapi.Error{Code: http.StatusForbidden},
+		},
+	}
+	b := newBackoff(0, 1, 0, 0)
+
+	clusters, err := findProjectsClusters(context.Background(), lister, []string{"host"}, b)
+	if err != nil {
+		t.Fatalf("Could not find clusters: %v", err)
+	}
+	if !reflect.DeepEqual(clusterNames(clusters), []string{"shared"}) {
+		t.Fatalf("Expected a single project to keep cluster names, got %v", clusterNames(clusters))
+	}
+
+	clusters, err = findProjectsClusters(context.Background(), lister, []string{"host", "service-a", "service-b", "forbidden"}, b)
+	if err != nil {
+		t.Fatalf("Could not find clusters: %v", err)
+	}
+	// Adding service projects doesn't rename the host project's clusters
+	expected := []string{"shared", "service-a_prod", "service-b_prod"}
+	if !reflect.DeepEqual(clusterNames(clusters), expected) {
+		t.Fatalf("Difference in expected clusters\nGot: %v\nExpected: %v\n", clusterNames(clusters), expected)
+	}
+	if (*lister)["service-a"].clusters["europe-west1-b"][0].Name != "prod" {
+		t.Fatalf("Expected the listed clusters to be left unmodified")
+	}
+
+	failOnPartial = true
+	if _, err := findProjectsClusters(context.Background(), lister, []string{"host", "forbidden"}, b); err == nil {
+		t.Fatalf("Expected an error for a forbidden project with -fail-on-partial")
+	}
+}
+
+// projectsClusterLister serves each project from its own fakeClusterLister
+type projectsClusterLister map[string]*fakeClusterLister
+
+func (l *projectsClusterLister) ListZones(ctx context.Context, project string) ([]string, error) {
+	return (*l)[project].ListZones(ctx, project)
+}
+
+func (l *projectsClusterLister) ListClusters(ctx context.Context, project, zone string) ([]*container.Cluster, error) {
+	return (*l)[project].ListClusters(ctx, project, zone)
+}
+
+func (l *projectsClusterLister) GetCluster(ctx context.Context, project, location, name string) (*container.Cluster, error) {
+	return (*l)[project].GetCluster(ctx, project, location, name)
+}
+
+func TestGetClusters(t *testing.T) {
+	t.Parallel()
+
+	lister := &fakeClusterLister{
+		clusters: map[string][]*container.Cluster{
+			"europe-west1": {
+				{Name: "a", Endpoint: "10.0.0.1"},
+				{Name: "provisioning"},
+			},
+			"us-east1-b": {
+				{Name: "b", Endpoint: "10.0.0.2"},
+			},
+		},
+	}
+
+	cases := []struct {
+		name     string
+		refs     []string
+		expected []string
+		valid    bool
+	}{
+		{name: "found", refs: []string{"project/us-east1-b/b", "project/europe-west1/a"}, expected: []string{"b", "a"}, valid: true},
+		{name: "no endpoint", refs: []string{"project/europe-west1/provisioning"}, expected: []string{}, valid: true},
+		{name: "missing", refs: []string{"project/europe-west1/a", "project/europe-west1/c"}, valid: false},
+		{name: "malformed", refs: []string{"project/a"}, valid: false},
+	}
+
+	for _, c := range cases {
+		clusters, err := getClusters(context.Background(), lister, c.refs)
+		if (err == nil) != c.valid {
+			t.Fatalf("%v: difference in expected validity\nGot: %v\nExpected valid: %v\n", c.name, err, c.valid)
+		}
+		if c.valid && !reflect.DeepEqual(clusterNames(clusters), c.expected) {
+			t.Fatalf("%v: difference in expected clusters\nGot: %v\nExpected: %v\n", c.name, clusterNames(clusters), c.expected)
+		}
+	}
+}
+
+func TestDiscoveryErrorReason(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		err      error
+		expected string
+	}{
+		{&googleapi.Error{Code: http.StatusForbidden}, "permission"},
+		{errors.Wrap(&googleapi.Error{Code: http.StatusForbidden}, "could not list clusters"), "permission"},
+		{&googleapi.Error{Code: http.StatusForbidden, Errors: []googleapi.ErrorItem{{Reason: "rateLimitExceeded"}}}, "quota"},
+		{&googleapi.Error{Code: http.StatusTooManyRequests}, "quota"},
+		{errors.Wrap(&googleapi.Error{Code: http.StatusNotFound}, "could not get cluster"), "not_found"},
+		{errors.Wrap(&net.OpError{Op: "dial", Err: errors.New("connection refused")}, "could not list zones"), "network"},
+		{&googleapi.Error{Code: http.StatusInternalServerError}, "other"},
+		{errors.New("unexpected response"), "other"},
+	}
+
+	for i, c := range cases {
+		if got := discoveryErrorReason(c.err); got != c.expected {
+			t.Errorf("case %d: expected %v for %v, got %v", i, c.expected, c.err, got)
+		}
+	}
+}
+
+func TestFilterReleaseChannels(t *testing.T) {
+	t.Parallel()
+
+	clusters := []*container.Cluster{
+		{Name: "stable", ReleaseChannel: &container.ReleaseChannel{Channel: "STABLE"}},
+		{Name: "rapid", ReleaseChannel: &container.ReleaseChannel{Channel: "RAPID"}},
+		{Name: "unspecified", ReleaseChannel: &container.ReleaseChannel{Channel: "UNSPECIFIED"}},
+		{Name: "none"},
+	}
+
+	cases := []struct {
+		channels []string
+		expected []string
+	}{
+		{[]string{"stable"}, []string{"stable"}},
+		{[]string{"STABLE", "static"}, []string{"stable", "unspecified", "none"}},
+		{[]string{"regular"}, []string{}},
+	}
+
+	for _, c := range cases {
+		got := []string{}
+		for _, cl := range filterReleaseChannels(clusters, c.channels) {
+			got = append(got, cl.Name)
+		}
+		if !reflect.DeepEqual(got, c.expected) {
+			t.Errorf("Difference in expected clusters for %v\nGot: %v\nExpected: %v\n", c.channels, got, c.expected)
+		}
+	}
+}
+
+func TestFilterNetwork(t *testing.T) {
+	t.Parallel()
+
+	clusters := []*container.Cluster{
+		{Name: "default", Network: "default", Subnetwork: "default"},
+		{Name: "shared-a", Network: "shared", Subnetwork: "a"},
+		{Name: "shared-b", Network: "shared", Subnetwork: "b"},
+	}
+
+	cases := []struct {
+		network    string
+		subnetwork string
+		expected   []string
+	}{
+		{"shared", "", []string{"shared-a", "shared-b"}},
+		{"projects/host/global/networks/shared", "b", []string{"shared-b"}},
+		{"", "projects/host/regions/europe-west1/subnetworks/a", []string{"shared-a"}},
+		{"other", "", []string{}},
+	}
+
+	for _, c := range cases {
+		got := []string{}
+		for _, cl := range filterNetwork(clusters, c.network, c.subnetwork) {
+			got = append(got, cl.Name)
+		}
+		if !reflect.DeepEqual(got, c.expected) {
+			t.Errorf("Difference in expected clusters for %v/%v\nGot: %v\nExpected: %v\n", c.network, c.subnetwork, got, c.expected)
+		}
+	}
+}
+
+func TestFilterClusterLabel(t *testing.T) {
+	t.Parallel()
+
+	clusters := []*container.Cluster{
+		{Name: "opted-in", ResourceLabels: map[string]string{"prometheus-scrape": "true"}},
+		{Name: "opted-out", ResourceLabels: map[string]string{"prometheus-scrape": "false"}},
+		{Name: "unlabeled"},
+	}
+
+	cases := []struct {
+		label    string
+		expected []string
+	}{
+		{"prometheus-scrape=true", []string{"opted-in"}},
+		{"prometheus-scrape", []string{"opted-in", "opted-out"}},
+	}
+
+	for _, c := range cases {
+		got := []string{}
+		for _, cl := range filterClusterLabel(clusters, c.label) {
+			got = append(got, cl.Name)
+		}
+		if !reflect.DeepEqual(got, c.expected) {
+			t.Errorf("Difference in expected clusters for %v\nGot: %v\nExpected: %v\n", c.label, got, c.expected)
+		}
+	}
+}
+
+func TestDedupeClusters(t *testing.T) {
+	t.Parallel()
+
+	clusters := []*container.Cluster{
+		{Name: "a", Location: "europe-west1-b"},
+		{Name: "a", Location: "europe-west1-b"},
+		{Name: "a", Location: "europe-west1"},
+		{Name: "b", Zone: "europe-west1-c"},
+		{Name: "b", Zone: "europe-west1-c"},
+	}
+
+	result := dedupeClusters("project", clusters)
+	if len(result) != 3 {
+		t.Fatalf("Expected 3 distinct clusters, got %v", len(result))
+	}
+	if result[0] != clusters[0] {
+		t.Fatalf("Expected first occurrence to be kept")
+	}
+}
+
+func TestHoldUnstableClusters(t *testing.T) {
+	t.Parallel()
+
+	previous := []*container.Cluster{
+		{Name: "upgrading", Endpoint: "10.0.0.1", Status: "RUNNING"},
+		{Name: "stable", Endpoint: "10.0.0.2", Status: "RUNNING"},
+	}
+	clusters := []*container.Cluster{
+		{Name: "upgrading", Endpoint: "10.0.0.3", Status: "RECONCILING"},
+		{Name: "stable", Endpoint: "10.0.0.4", Status: "RUNNING"},
+		{Name: "new", Endpoint: "10.0.0.5", Status: "DEGRADED"},
+	}
+
+	got := holdUnstableClusters(previous, clusters)
+	endpoints := []string{}
+	for _, c := range got {
+		endpoints = append(endpoints, c.Endpoint)
+	}
+	expected := []string{"10.0.0.1", "10.0.0.4", "10.0.0.5"}
+	if !reflect.DeepEqual(endpoints, expected) {
+		t.Fatalf("Difference in expected endpoints\nGot: %v\nExpected: %v\n", endpoints, expected)
+	}
+}
+
+func TestGCPClusterListerListZonesPages(t *testing.T) {
+	t.Parallel()
+	pages := map[string]string{
+		"":       `{"items": [{"name": "europe-west1-b"}, {"name": "europe-west1-c"}], "nextPageToken": "page-2"}`,
+		"page-2": `{"items": [{"name": "us-east1-b"}]}`,
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/projects/project/zones" {
+			http.NotFound(w, r)
+			return
+		}
+		page, ok := pages[r.URL.Query().Get("pageToken")]
+		if !ok {
+			http.Error(w, "unknown page", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, page)
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	svc, err := compute.NewService(ctx, option.WithEndpoint(srv.URL+"/"), option.WithHTTPClient(srv.Client()))
+	if err != nil {
+		t.Fatalf("could not create compute service: %v", err)
+	}
+	lister := &gcpClusterLister{compute: svc}
+
+	zones, err := lister.ListZones(ctx, "project")
+	if err != nil {
+		t.Fatalf("ListZones() returned error: %v", err)
+	}
+	expected := []string{"europe-west1-b", "europe-west1-c", "us-east1-b"}
+	if !reflect.DeepEqual(zones, expected) {
+		t.Errorf("ListZones() = %v, expected zones from every page %v", zones, expected)
+	}
+}
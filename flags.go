@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// floatSliceFlag is a flag.Value holding a comma separated list of strictly increasing floats,
+// as histogram buckets must be
+type floatSliceFlag []float64
+
+func (f *floatSliceFlag) String() string {
+	strs := make([]string, 0, len(*f))
+	for _, v := range *f {
+		strs = append(strs, strconv.FormatFloat(v, 'g', -1, 64))
+	}
+	return strings.Join(strs, ",")
+}
+
+func (f *floatSliceFlag) Set(value string) error {
+	if strings.TrimSpace(value) == "" {
+		return errors.New("at least one value is required")
+	}
+	values := []float64{}
+	for _, s := range strings.Split(value, ",") {
+		v, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+		if err != nil {
+			return errors.Wrapf(err, "could not parse %q as a float", s)
+		}
+		values = append(values, v)
+	}
+	for i := 1; i < len(values); i++ {
+		if values[i] <= values[i-1] {
+			return errors.Errorf("values must be in strictly increasing order, %v follows %v", values[i], values[i-1])
+		}
+	}
+	*f = values
+	return nil
+}
+
+// fileModeFlag is a flag.Value holding octal file permissions
+type fileModeFlag os.FileMode
+
+func (f *fileModeFlag) String() string {
+	return fmt.Sprintf("%#o", uint32(*f))
+}
+
+func (f *fileModeFlag) Set(value string) error {
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil {
+		return errors.Wrapf(err, "could not parse %q as an octal file mode", value)
+	}
+	if os.FileMode(mode)&^os.ModePerm != 0 {
+		return errors.Errorf("file mode %q has bits set outside of the permission bits", value)
+	}
+	*f = fileModeFlag(mode)
+	return nil
+}
+
+// stringSliceFlag is a flag.Value holding a comma separated list of strings
+type stringSliceFlag []string
+
+func (f *stringSliceFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringSliceFlag) Set(value string) error {
+	values := []string{}
+	for _, s := range strings.Split(value, ",") {
+		s = strings.TrimSpace(s)
+		if s != "" {
+			values = append(values, s)
+		}
+	}
+	*f = values
+	return nil
+}
+
+// labelsFlag is a flag.Value holding comma separated key=value label pairs
+type labelsFlag map[string]string
+
+var labelNameRegex = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*$")
+
+func (f *labelsFlag) String() string {
+	pairs := make([]string, 0, len(*f))
+	for k, v := range *f {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (f *labelsFlag) Set(value string) error {
+	labels := labelsFlag{}
+	for _, s := range strings.Split(value, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		kv := strings.SplitN(s, "=", 2)
+		if len(kv) != 2 {
+			return errors.Errorf("could not parse %q as key=value", s)
+		}
+		if !labelNameRegex.MatchString(kv[0]) {
+			return errors.Errorf("%q is not a valid label name", kv[0])
+		}
+		labels[kv[0]] = kv[1]
+	}
+	*f = labels
+	return nil
+}
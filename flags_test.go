@@ -0,0 +1,144 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFloatSliceFlag(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		value    string
+		expected floatSliceFlag
+		valid    bool
+	}{
+		{
+			value:    "0.5, 1,10,120",
+			expected: floatSliceFlag{0.5, 1, 10, 120},
+			valid:    true,
+		},
+		{
+			value: "1,abc",
+			valid: false,
+		},
+		{
+			value: "10,1",
+			valid: false,
+		},
+		{
+			value: "1,1",
+			valid: false,
+		},
+		{
+			value: "",
+			valid: false,
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.value, func(t *testing.T) {
+			t.Parallel()
+
+			f := floatSliceFlag{}
+			err := f.Set(c.value)
+			if (err == nil) != c.valid {
+				t.Fatalf("Difference in expected validity\nGot: %v\nExpected valid: %v\n", err, c.valid)
+			}
+			if c.valid && !reflect.DeepEqual(f, c.expected) {
+				t.Fatalf("Difference in expected result\nGot: %v\nExpected: %v\n", f, c.expected)
+			}
+		})
+	}
+}
+
+func TestFileModeFlag(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		value    string
+		expected fileModeFlag
+		valid    bool
+	}{
+		{
+			value:    "0644",
+			expected: 0644,
+			valid:    true,
+		},
+		{
+			value:    "440",
+			expected: 0440,
+			valid:    true,
+		},
+		{
+			value: "0999",
+			valid: false,
+		},
+		{
+			value: "10644",
+			valid: false,
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.value, func(t *testing.T) {
+			t.Parallel()
+
+			var f fileModeFlag
+			err := f.Set(c.value)
+			if (err == nil) != c.valid {
+				t.Fatalf("Difference in expected validity\nGot: %v\nExpected valid: %v\n", err, c.valid)
+			}
+			if c.valid && f != c.expected {
+				t.Fatalf("Difference in expected result\nGot: %v\nExpected: %v\n", f.String(), c.expected.String())
+			}
+		})
+	}
+}
+
+func TestLabelsFlag(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		value    string
+		expected labelsFlag
+		valid    bool
+	}{
+		{
+			value:    "env=prod, team=infra",
+			expected: labelsFlag{"env": "prod", "team": "infra"},
+			valid:    true,
+		},
+		{
+			value:    "url=http://a/?b=c",
+			expected: labelsFlag{"url": "http://a/?b=c"},
+			valid:    true,
+		},
+		{
+			value: "env",
+			valid: false,
+		},
+		{
+			value: "0env=prod",
+			valid: false,
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.value, func(t *testing.T) {
+			t.Parallel()
+
+			f := labelsFlag{}
+			err := f.Set(c.value)
+			if (err == nil) != c.valid {
+				t.Fatalf("Difference in expected validity\nGot: %v\nExpected valid: %v\n", err, c.valid)
+			}
+			if c.valid && !reflect.DeepEqual(f, c.expected) {
+				t.Fatalf("Difference in expected result\nGot: %v\nExpected: %v\n", f, c.expected)
+			}
+		})
+	}
+}
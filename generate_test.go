@@ -0,0 +1,589 @@
+package main
+
+import (
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	container "google.golang.org/api/container/v1"
+	"gopkg.in/yaml.v2"
+)
+
+func testConfigOptions() configOptions {
+	return configOptions{
+		CertDir:         "/etc/gke-certs",
+		RetryInterval:   30 * time.Second,
+		NodeScrapeVia:   "kubelet",
+		NodeMetricsPort: readOnlyKubeletPort,
+	}
+}
+
+func testCluster() *container.Cluster {
+	return &container.Cluster{
+		Name:     "prod",
+		Endpoint: "10.0.0.1",
+		MasterAuth: &container.MasterAuth{
+			Username:             "admin",
+			Password:             "secret",
+			ClusterCaCertificate: "Y2E=",
+			ClientCertificate:    "Y2VydA==",
+			ClientKey:            "a2V5",
+		},
+		PrivateClusterConfig: &container.PrivateClusterConfig{
+			PrivateEndpoint: "172.16.0.2",
+		},
+	}
+}
+
+func TestBuildConfigOutput(t *testing.T) {
+	t.Parallel()
+
+	input := PrometheusConfig{ScrapeConfigs: []ScrapeConfig{{JobName: "prometheus"}}}
+	roles := map[string]Role{
+		"pod": {
+			RelabelConfigs: []RelabelConfig{
+				{
+					SourceLabels: []string{"__meta_kubernetes_pod_annotation_prometheus_io_scrape"},
+					Action:       "keep",
+					Regex:        "true",
+				},
+			},
+		},
+	}
+
+	config, err := buildConfig(input, testConfigOptions(), roles, []*container.Cluster{testCluster()})
+	if err != nil {
+		t.Fatalf("Could not build config: %v", err)
+	}
+	if len(input.ScrapeConfigs) != 1 {
+		t.Fatalf("Expected the input config to be left unmodified, got %+v", input)
+	}
+
+	data, err := yaml.Marshal(config)
+	if err != nil {
+		t.Fatalf("Could not marshal config: %v", err)
+	}
+	expected := `scrape_configs:
+- job_name: prometheus
+- job_name: kubernetes_prod_pod
+  kubernetes_sd_configs:
+  - api_servers:
+    - https://10.0.0.1
+    role: pod
+    tls_config:
+      ca_file: /etc/gke-certs/prod-ca.pem
+      cert_file: /etc/gke-certs/prod-cert.pem
+      key_file: /etc/gke-certs/prod-key.pem
+    retry_interval: 30s
+  relabel_configs:
+  - source_labels: [__meta_kubernetes_pod_annotation_prometheus_io_scrape]
+    regex: "true"
+    action: keep
+  basic_auth:
+    username: admin
+    password: secret
+`
+	if string(data) != expected {
+		t.Fatalf("Difference in expected config\nGot:\n%s\nExpected:\n%s\n", data, expected)
+	}
+}
+
+func TestBuildConfigMinimal(t *testing.T) {
+	t.Parallel()
+
+	cluster := &container.Cluster{
+		Name:       "prod",
+		Endpoint:   "10.0.0.1",
+		MasterAuth: &container.MasterAuth{ClusterCaCertificate: "Y2E="},
+	}
+	roles := map[string]Role{
+		"pod":     {RelabelConfigs: []RelabelConfig{{Action: "labelmap", Regex: "__meta_kubernetes_pod_label_(.+)"}}},
+		"service": {},
+	}
+
+	config, err := buildConfig(PrometheusConfig{}, configOptions{CertDir: "/etc/gke-certs"}, roles, []*container.Cluster{cluster})
+	if err != nil {
+		t.Fatalf("Could not build config: %v", err)
+	}
+	data, err := yaml.Marshal(config)
+	if err != nil {
+		t.Fatalf("Could not marshal config: %v", err)
+	}
+	expected := `scrape_configs:
+- job_name: kubernetes_prod_pod
+  kubernetes_sd_configs:
+  - api_servers:
+    - https://10.0.0.1
+    role: pod
+    tls_config:
+      ca_file: /etc/gke-certs/prod-ca.pem
+  relabel_configs:
+  - regex: __meta_kubernetes_pod_label_(.+)
+    action: labelmap
+- job_name: kubernetes_prod_service
+  kubernetes_sd_configs:
+  - api_servers:
+    - https://10.0.0.1
+    role: service
+    tls_config:
+      ca_file: /etc/gke-certs/prod-ca.pem
+`
+	if string(data) != expected {
+		t.Fatalf("Difference in expected config\nGot:\n%s\nExpected:\n%s\n", data, expected)
+	}
+}
+
+func TestBuildConfigInvalidRole(t *testing.T) {
+	t.Parallel()
+
+	roles := map[string]Role{
+		"pod": {RelabelConfigs: []RelabelConfig{{Action: "keepall"}}},
+	}
+	if _, err := buildConfig(PrometheusConfig{}, testConfigOptions(), roles, []*container.Cluster{testCluster()}); err == nil {
+		t.Fatalf("Expected an error for an invalid relabel config")
+	}
+}
+
+func TestBuildConfigDuplicateJobs(t *testing.T) {
+	t.Parallel()
+
+	roles := map[string]Role{"pod": builtinRoles()["pod"]}
+	if _, err := buildConfig(PrometheusConfig{}, testConfigOptions(), roles, []*container.Cluster{testCluster(), testCluster()}); err == nil {
+		t.Fatalf("Expected an error for two clusters generating the same job")
+	}
+	input := PrometheusConfig{ScrapeConfigs: []ScrapeConfig{{JobName: "kubernetes_prod_pod"}}}
+	if _, err := buildConfig(input, testConfigOptions(), roles, []*container.Cluster{testCluster()}); err == nil {
+		t.Fatalf("Expected an error for a generated job already in the input")
+	}
+}
+
+func TestClusterToScrapeConfigsOptions(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name     string
+		role     string
+		opts     func(*configOptions)
+		expected []string
+		absent   []string
+	}{
+		{
+			name:     "ca bundle",
+			role:     "pod",
+			opts:     func(o *configOptions) { o.CABundle = true },
+			expected: []string{"ca_file: /etc/gke-certs/ca-bundle.pem"},
+			absent:   []string{"prod-ca.pem"},
+		},
+		{
+			name:     "ca only",
+			role:     "pod",
+			opts:     func(o *configOptions) { o.TLSCAOnly = true },
+			expected: []string{"ca_file: /etc/gke-certs/prod-ca.pem"},
+			absent:   []string{"cert_file", "key_file"},
+		},
+		{
+			name:     "password file",
+			role:     "pod",
+			opts:     func(o *configOptions) { o.BasicAuthPasswordFile = true },
+			expected: []string{"password_file: /etc/gke-certs/prod-password"},
+			absent:   []string{"secret"},
+		},
+		{
+			name: "password file template",
+			role: "pod",
+			opts: func(o *configOptions) {
+				o.PasswordFileTemplate, _ = parsePasswordFileTemplate("/etc/secrets/{{ .ClusterName }}/password")
+			},
+			expected: []string{"password: secret"},
+			absent:   []string{"password_file"},
+		},
+		{
+			name:     "kubeconfig",
+			role:     "pod",
+			opts:     func(o *configOptions) { o.SDKubeconfig = true },
+			expected: []string{"kubeconfig_file: /etc/gke-certs/prod-kubeconfig.yml"},
+			absent:   []string{"api_servers"},
+		},
+		{
+			name:     "private endpoint",
+			role:     "pod",
+			opts:     func(o *configOptions) { o.PreferPrivateEndpoint = true },
+			expected: []string{"https://172.16.0.2"},
+			absent:   []string{"10.0.0.1"},
+		},
+		{
+			name: "namespace scoping",
+			role: "pod",
+			opts: func(o *configOptions) {
+				o.NamespaceAllowlist = []string{"default", "kube-system"}
+				o.NamespaceDenylist = []string{"kube-system"}
+			},
+			expected: []string{"regex: default|kube-system\n  action: keep\n- source_labels: [__meta_kubernetes_pod_namespace]\n  regex: kube-system\n  action: drop"},
+		},
+		{
+			name:     "static labels",
+			role:     "pod",
+			opts:     func(o *configOptions) { o.StaticTargetLabels = map[string]string{"env": "prod"} },
+			expected: []string{"target_label: env\n  replacement: prod"},
+		},
+		{
+			name:     "generation",
+			role:     "pod",
+			opts:     func(o *configOptions) { o.Generation = 42 },
+			expected: []string{"target_label: gkesd_generation\n  replacement: \"42\""},
+		},
+		{
+			name:     "apiserver https",
+			role:     "apiserver",
+			opts:     func(o *configOptions) {},
+			expected: []string{"scheme: https", "tls_config:\n  ca_file: /etc/gke-certs/prod-ca.pem"},
+		},
+		{
+			name:     "cluster target label",
+			role:     "pod",
+			opts:     func(o *configOptions) { o.ClusterTargetLabel = true },
+			expected: []string{"relabel_configs:\n- source_labels: [__meta_kubernetes_pod_annotation_prometheus_io_scrape]", "target_label: cluster\n  replacement: prod"},
+			absent:   []string{"metric_relabel_configs"},
+		},
+		{
+			name:     "cluster metric label",
+			role:     "pod",
+			opts:     func(o *configOptions) { o.ClusterMetricLabel = true },
+			expected: []string{"metric_relabel_configs:\n- target_label: cluster\n  replacement: prod"},
+		},
+		{
+			name:     "node scrape label",
+			role:     "node",
+			opts:     func(o *configOptions) { o.NodeRequireScrapeLabel = true },
+			expected: []string{"- source_labels: [__meta_kubernetes_node_label_prometheus_io_scrape]\n  regex: \"true\"\n  action: keep\n- regex: __meta_kubernetes_node_label_(.+)"},
+		},
+		{
+			name:     "pod named ports",
+			role:     "pod",
+			opts:     func(o *configOptions) { o.PodNamedPorts = true },
+			expected: []string{"target_label: __tmp_port_name\n  action: keepequal\n- source_labels: [__meta_kubernetes_pod_annotation_prometheus_io_scrape]"},
+		},
+		{
+			name:     "node via apiserver",
+			role:     "node",
+			opts:     func(o *configOptions) { o.NodeScrapeVia = "apiserver" },
+			expected: []string{"scheme: https", "replacement: 10.0.0.1:443"},
+			absent:   []string{"insecure_skip_verify", "replacement: ${1}:"},
+		},
+		{
+			name:     "node read-only kubelet",
+			role:     "node",
+			opts:     func(o *configOptions) {},
+			expected: []string{"replacement: ${1}:10255"},
+			absent:   []string{"scheme: https"},
+		},
+		{
+			name:     "node secure kubelet",
+			role:     "node",
+			opts:     func(o *configOptions) { o.NodeMetricsPort = 10250 },
+			expected: []string{"scheme: https", "insecure_skip_verify: true", "replacement: ${1}:10250"},
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+
+			opts := testConfigOptions()
+			c.opts(&opts)
+			roles := map[string]Role{c.role: builtinRoles()[c.role]}
+			scs := clusterToScrapeConfigs(opts, roles, testCluster())
+			if len(scs) != 1 {
+				t.Fatalf("Expected a single scrape config, got %+v", scs)
+			}
+			data, err := yaml.Marshal(scs[0])
+			if err != nil {
+				t.Fatalf("Could not marshal scrape config: %v", err)
+			}
+			for _, e := range c.expected {
+				if !strings.Contains(string(data), e) {
+					t.Fatalf("Expected %q in output\nGot: %s", e, data)
+				}
+			}
+			for _, a := range c.absent {
+				if strings.Contains(string(data), a) {
+					t.Fatalf("Expected no %q in output\nGot: %s", a, data)
+				}
+			}
+		})
+	}
+}
+
+func TestClusterBasicAuthPasswordFileTemplate(t *testing.T) {
+	t.Parallel()
+
+	opts := testConfigOptions()
+	tmpl, err := parsePasswordFileTemplate("/etc/secrets/{{ .ClusterName }}/password")
+	if err != nil {
+		t.Fatalf("Could not parse template: %v", err)
+	}
+	opts.PasswordFileTemplate = tmpl
+
+	cluster := testCluster()
+	cluster.MasterAuth.Password = ""
+	auth := clusterBasicAuth(opts, cluster)
+	if auth.PasswordFile != "/etc/secrets/prod/password" || auth.Password != "" {
+		t.Fatalf("Expected the templated password file, got %+v", auth)
+	}
+
+	opts.PasswordFileTemplate, err = parsePasswordFileTemplate("/etc/secrets/{{ .Project }}/{{ .Location }}/{{ .ClusterName }}-{{ .Type }}")
+	if err != nil {
+		t.Fatalf("Could not parse template: %v", err)
+	}
+	cluster.SelfLink = "https://container.googleapis.com/v1/projects/p/zones/us-east1-b/clusters/prod"
+	cluster.Location = "us-east1-b"
+	auth = clusterBasicAuth(opts, cluster)
+	if auth.PasswordFile != "/etc/secrets/p/us-east1-b/prod-password" {
+		t.Fatalf("Expected the password file templated like cert filenames, got %+v", auth)
+	}
+
+	if _, err := parsePasswordFileTemplate("/etc/secrets/{{ .Name }}/password"); err == nil {
+		t.Fatalf("Expected an error for a template referencing an unknown field")
+	}
+}
+
+func TestClusterBasicAuthWithoutCredentials(t *testing.T) {
+	t.Parallel()
+
+	cluster := testCluster()
+	cluster.MasterAuth.Username = ""
+	cluster.MasterAuth.Password = ""
+	if auth := clusterBasicAuth(testConfigOptions(), cluster); auth != nil {
+		t.Fatalf("Expected no basic auth for a cluster without credentials, got %+v", auth)
+	}
+
+	data, err := yaml.Marshal(clusterToScrapeConfigs(testConfigOptions(), builtinRoles(), cluster))
+	if err != nil {
+		t.Fatalf("Could not marshal scrape configs: %v", err)
+	}
+	if strings.Contains(string(data), "basic_auth") {
+		t.Fatalf("Expected no basic_auth for a cluster without credentials\nGot: %s", data)
+	}
+}
+
+func TestClusterEndpoint(t *testing.T) {
+	t.Parallel()
+
+	cluster := testCluster()
+	if e := clusterEndpoint(cluster, false); e != "10.0.0.1" {
+		t.Fatalf("Expected the public endpoint, got %v", e)
+	}
+	if e := clusterEndpoint(cluster, true); e != "172.16.0.2" {
+		t.Fatalf("Expected the private endpoint, got %v", e)
+	}
+	cluster.PrivateClusterConfig = nil
+	if e := clusterEndpoint(cluster, true); e != "10.0.0.1" {
+		t.Fatalf("Expected a fallback to the public endpoint, got %v", e)
+	}
+}
+
+// relabelTarget applies the replace, keep, drop and labelmap relabel configs rcs to a target's
+// labels as Prometheus would, returning the resulting labels and whether the target is kept
+func relabelTarget(labels map[string]string, rcs []RelabelConfig) (map[string]string, bool) {
+	out := map[string]string{}
+	for k, v := range labels {
+		out[k] = v
+	}
+	for _, rc := range rcs {
+		values := make([]string, 0, len(rc.SourceLabels))
+		for _, l := range rc.SourceLabels {
+			values = append(values, out[l])
+		}
+		separator := ";"
+		if rc.Seperator != "" {
+			separator = rc.Seperator
+		}
+		value := strings.Join(values, separator)
+		regex := "(.*)"
+		if rc.Regex != "" {
+			regex = rc.Regex
+		}
+		re := regexp.MustCompile("^(?:" + regex + ")$")
+
+		switch rc.Action {
+		case "", "replace":
+			m := re.FindStringSubmatchIndex(value)
+			if m == nil {
+				continue
+			}
+			replacement := "$1"
+			if rc.Replacement != "" {
+				replacement = rc.Replacement
+			}
+			target := string(re.ExpandString(nil, rc.TargetLabel, value, m))
+			res := string(re.ExpandString(nil, replacement, value, m))
+			if res == "" {
+				delete(out, target)
+			} else {
+				out[target] = res
+			}
+		case "keep":
+			if !re.MatchString(value) {
+				return out, false
+			}
+		case "drop":
+			if re.MatchString(value) {
+				return out, false
+			}
+		case "labelmap":
+			for k, v := range labels {
+				if re.MatchString(k) {
+					out[re.ReplaceAllString(k, rc.Replacement)] = v
+				}
+			}
+		}
+	}
+	return out, true
+}
+
+func TestAPIServerTargetRelabeling(t *testing.T) {
+	t.Parallel()
+
+	for _, sc := range clusterToScrapeConfigs(testConfigOptions(), builtinRoles(), testCluster()) {
+		if sc.JobName != "kubernetes_prod_apiserver" {
+			continue
+		}
+		if sc.KubernetesSDConfigs[0].Role != "apiserver" {
+			t.Fatalf("Expected an apiserver role SD config, got %+v", sc.KubernetesSDConfigs[0])
+		}
+		// The apiserver role gives targets only an address, and the job sets their scheme
+		labels, kept := relabelTarget(map[string]string{
+			"__address__":      "10.0.0.1:443",
+			"__scheme__":       sc.Scheme,
+			"__metrics_path__": "/metrics",
+		}, sc.RelabelConfigs)
+		if !kept {
+			t.Fatalf("Expected the API server target to be kept by %+v", sc.RelabelConfigs)
+		}
+		if labels["__scheme__"] != "https" || labels["cluster"] != "prod" {
+			t.Fatalf("Expected an https target labeled with its cluster, got %v", labels)
+		}
+		if sc.TLSConfig == nil || sc.TLSConfig.CertFile != "/etc/gke-certs/prod-cert.pem" {
+			t.Fatalf("Expected the API server to be scraped with the cluster credentials, got %+v", sc.TLSConfig)
+		}
+		return
+	}
+	t.Fatalf("Expected an apiserver job")
+}
+
+func TestClusterScrapeInterval(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		label string
+		value string
+		want  string
+	}{
+		{"", "30s", ""},
+		{"prometheus-interval", "", ""},
+		{"prometheus-interval", "30s", "30s"},
+		{"prometheus-interval", "90s", "1m30s"},
+		{"prometheus-interval", "10500ms", "10500ms"},
+		{"prometheus-interval", "5s", ""},
+		{"prometheus-interval", "fast", ""},
+		{"prometheus-interval", "-1m", ""},
+	}
+
+	for _, tt := range tests {
+		opts := testConfigOptions()
+		opts.ScrapeIntervalLabel = tt.label
+		cluster := testCluster()
+		if tt.value != "" {
+			cluster.ResourceLabels = map[string]string{"prometheus-interval": tt.value}
+		}
+		for _, sc := range clusterToScrapeConfigs(opts, builtinRoles(), cluster) {
+			if sc.ScrapeInterval != tt.want {
+				t.Fatalf("Expected %v with label %q=%q to have scrape interval %q, got %q", sc.JobName, tt.label, tt.value, tt.want, sc.ScrapeInterval)
+			}
+		}
+	}
+}
+
+func TestBuildConfigScrapeIntervalTimeout(t *testing.T) {
+	t.Parallel()
+
+	opts := testConfigOptions()
+	opts.ScrapeIntervalLabel = "prometheus-interval"
+	short, long := testCluster(), testCluster()
+	short.Name, long.Name = "short", "long"
+	short.ResourceLabels = map[string]string{"prometheus-interval": "20s"}
+	long.ResourceLabels = map[string]string{"prometheus-interval": "30s"}
+
+	input := PrometheusConfig{Global: &GlobalConfig{ScrapeTimeout: "30s"}}
+	config, err := buildConfig(input, opts, map[string]Role{"pod": builtinRoles()["pod"]}, []*container.Cluster{short, long})
+	if err != nil {
+		t.Fatalf("Could not build config: %v", err)
+	}
+	if len(config.ScrapeConfigs) != 2 || config.ScrapeConfigs[0].ScrapeInterval != "" || config.ScrapeConfigs[1].ScrapeInterval != "30s" {
+		t.Fatalf("Expected only the interval no shorter than the global scrape timeout to be used, got %+v", config.ScrapeConfigs)
+	}
+}
+
+func TestAppendUniqueJobs(t *testing.T) {
+	t.Parallel()
+
+	scrapeConfigs := []ScrapeConfig{{JobName: "prometheus"}, {JobName: "kubernetes_prod_pod"}}
+	extra := []ScrapeConfig{
+		{JobName: "node", Scheme: "http"},
+		{JobName: "prometheus", Scheme: "https"},
+		{JobName: "node", Scheme: "https"},
+	}
+
+	got := appendUniqueJobs(scrapeConfigs, extra)
+	if len(got) != 3 || got[2].JobName != "node" || got[2].Scheme != "http" {
+		t.Fatalf("Expected only the first node job to be added, got %+v", got)
+	}
+}
+
+func TestWithoutGeneratedJobs(t *testing.T) {
+	t.Parallel()
+
+	input := PrometheusConfig{ScrapeConfigs: []ScrapeConfig{{JobName: "prometheus"}, {JobName: "z"}}}
+	output, err := buildConfig(input, testConfigOptions(), builtinRoles(), []*container.Cluster{testCluster()})
+	if err != nil {
+		t.Fatalf("Could not build config: %v", err)
+	}
+
+	again, err := buildConfig(PrometheusConfig{ScrapeConfigs: withoutGeneratedJobs(output.ScrapeConfigs)}, testConfigOptions(), builtinRoles(), []*container.Cluster{testCluster()})
+	if err != nil {
+		t.Fatalf("Could not build config: %v", err)
+	}
+	if !reflect.DeepEqual(again.ScrapeConfigs, output.ScrapeConfigs) {
+		t.Fatalf("Expected building from a stripped output to give the same output\nExpected: %+v\nGot: %+v", output.ScrapeConfigs, again.ScrapeConfigs)
+	}
+}
+
+func TestBuildConfigOrder(t *testing.T) {
+	t.Parallel()
+
+	input := PrometheusConfig{ScrapeConfigs: []ScrapeConfig{{JobName: "z"}, {JobName: "a"}}}
+	clusters := []*container.Cluster{testCluster(), testCluster()}
+	clusters[1].Name = "dev"
+
+	expected := []string{
+		"z", "a",
+		"kubernetes_prod_apiserver", "kubernetes_prod_endpoint", "kubernetes_prod_node", "kubernetes_prod_pod", "kubernetes_prod_service",
+		"kubernetes_dev_apiserver", "kubernetes_dev_endpoint", "kubernetes_dev_node", "kubernetes_dev_pod", "kubernetes_dev_service",
+	}
+	for i := 0; i < 10; i++ {
+		config, err := buildConfig(input, testConfigOptions(), builtinRoles(), clusters)
+		if err != nil {
+			t.Fatalf("Could not build config: %v", err)
+		}
+		got := []string{}
+		for _, sc := range config.ScrapeConfigs {
+			got = append(got, sc.JobName)
+		}
+		if strings.Join(got, ",") != strings.Join(expected, ",") {
+			t.Fatalf("Difference in expected job order\nGot: %v\nExpected: %v\n", got, expected)
+		}
+	}
+}
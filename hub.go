@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/golang/glog"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+
+	gkehub "google.golang.org/api/gkehub/v1"
+	"google.golang.org/api/option"
+)
+
+// connectGatewayHost is the host of the connect gateway, which proxies to the API servers of
+// clusters registered to a GKE Hub fleet
+const connectGatewayHost = "connectgateway.googleapis.com"
+
+// MembershipLister lists the GKE Hub memberships of a project
+type MembershipLister interface {
+	ListMemberships(ctx context.Context, project string) ([]*gkehub.Membership, error)
+}
+
+// gcpMembershipLister lists memberships with the GKE Hub api
+type gcpMembershipLister struct {
+	hub *gkehub.Service
+}
+
+func newGCPMembershipLister(ctx context.Context) (*gcpMembershipLister, error) {
+	hub, err := gkehub.NewService(ctx, option.WithScopes(gkehub.CloudPlatformScope), option.WithUserAgent(gcpUserAgent))
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create gke hub service")
+	}
+	return &gcpMembershipLister{hub: hub}, nil
+}
+
+func (l *gcpMembershipLister) ListMemberships(ctx context.Context, project string) ([]*gkehub.Membership, error) {
+	memberships := []*gkehub.Membership{}
+	parent := fmt.Sprintf("projects/%v/locations/-", project)
+	err := l.hub.Projects.Locations.Memberships.List(parent).Pages(ctx, func(page *gkehub.ListMembershipsResponse) error {
+		memberships = append(memberships, page.Resources...)
+		return nil
+	})
+	if err != nil {
+		return []*gkehub.Membership{}, errors.Wrap(err, "could not list memberships")
+	}
+	return memberships, nil
+}
+
+// hubMembership is a cluster registered to a GKE Hub fleet, reached through the connect gateway
+type hubMembership struct {
+	// Name is the membership's resource name, projects/p/locations/l/memberships/id
+	Name string
+}
+
+// nameParts returns the project, location and id of the membership from its name
+func (m hubMembership) nameParts() (project, location, id string) {
+	parts := strings.Split(m.Name, "/")
+	if len(parts) != 6 {
+		return "", "", m.Name[strings.LastIndex(m.Name, "/")+1:]
+	}
+	return parts[1], parts[3], parts[5]
+}
+
+// ID returns the membership's id, the last part of its name
+func (m hubMembership) ID() string {
+	_, _, id := m.nameParts()
+	return id
+}
+
+// Location returns the location the membership is registered in, such as global
+func (m hubMembership) Location() string {
+	_, location, _ := m.nameParts()
+	return location
+}
+
+// GatewayPath returns the path the connect gateway serves the membership's API server under,
+// which is gkeMemberships rather than the membership's own resource name
+func (m hubMembership) GatewayPath() string {
+	project, location, id := m.nameParts()
+	return fmt.Sprintf("/v1/projects/%v/locations/%v/gkeMemberships/%v", project, location, id)
+}
+
+// GatewayURL returns the connect gateway address of the membership's API server
+func (m hubMembership) GatewayURL() string {
+	return "https://" + connectGatewayHost + m.GatewayPath()
+}
+
+// findMemberships lists the memberships of project that are ready to be reached
+func findMemberships(ctx context.Context, lister MembershipLister, project string) ([]hubMembership, error) {
+	ms, err := lister.ListMemberships(ctx, project)
+	if err != nil {
+		discoveryErrors.WithLabelValues(project, discoveryErrorReason(err)).Inc()
+		return []hubMembership{}, err
+	}
+
+	memberships := []hubMembership{}
+	for _, m := range ms {
+		if m.State == nil || m.State.Code != "READY" {
+			log.V(2).Infof("Ignoring membership %v which isn't ready", m.Name)
+			continue
+		}
+		memberships = append(memberships, hubMembership{Name: m.Name})
+	}
+	return memberships, nil
+}
+
+// membershipListEqual returns whether old and new hold the same memberships, in any order
+func membershipListEqual(old, new []hubMembership) bool {
+	if len(old) != len(new) {
+		return false
+	}
+	names := map[string]bool{}
+	for _, m := range old {
+		names[m.Name] = true
+	}
+	for _, m := range new {
+		if !names[m.Name] {
+			return false
+		}
+	}
+	return true
+}
+
+// membershipsToScrapeConfigs returns the jobs for each role of each membership, discovering
+// targets through the connect gateway with the bearer token in tokenFile. Targets the API server
+// can proxy to are scraped through the gateway too, as they're rarely reachable directly. Membership
+// ids are only unique within a location, so job names include both.
+func membershipsToScrapeConfigs(opts configOptions, roles map[string]Role, memberships []hubMembership, tokenFile string) []ScrapeConfig {
+	configs := []ScrapeConfig{}
+	for _, m := range memberships {
+		for _, r := range roleNames(roles) {
+			role := roles[r]
+			proxyURL := opts.ProxyURL
+			if role.ProxyURL != "" {
+				proxyURL = role.ProxyURL
+			}
+			c := role.RelabelConfigs
+			scheme, tokens := role.Scheme, ""
+			if gc := hubGatewayRelabelConfigs(r, m.GatewayPath()); len(gc) > 0 {
+				// Copied first, as c may still share its backing array with the role
+				c = append(append([]RelabelConfig{}, c...), gc...)
+				scheme, tokens = "https", tokenFile
+			}
+			c, mc := clusterLabelConfigs(opts, r, m.ID(), c, role.MetricRelabelConfigs)
+			configs = append(configs, ScrapeConfig{
+				JobName: fmt.Sprintf("%vhub_%v_%v_%v", generatedJobPrefix, m.Location(), m.ID(), r),
+				KubernetesSDConfigs: []KubeSDConfig{
+					{
+						APIServers:      []string{m.GatewayURL()},
+						Role:            r,
+						RetryInterval:   opts.retryIntervalString(),
+						ProxyURL:        proxyURL,
+						BearerTokenFile: tokenFile,
+					},
+				},
+				RelabelConfigs:       scopeRelabelConfigs(opts, r, c),
+				MetricRelabelConfigs: mc,
+				HonorLabels:          role.HonorLabels,
+				HonorTimestamps:      role.HonorTimestamps,
+				SampleLimit:          role.SampleLimit,
+				TargetLimit:          role.TargetLimit,
+				ProxyURL:             proxyURL,
+				ScrapeProtocols:      role.ScrapeProtocols,
+				EnableHTTP2:          role.EnableHTTP2,
+				FollowRedirects:      role.FollowRedirects,
+				Scheme:               scheme,
+				MetricsPath:          role.MetricsPath,
+				BearerTokenFile:      tokens,
+			})
+		}
+	}
+	return configs
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+	gkehub "google.golang.org/api/gkehub/v1"
+	"gopkg.in/yaml.v2"
+)
+
+// fakeMembershipLister serves memberships from memory
+type fakeMembershipLister []*gkehub.Membership
+
+func (l fakeMembershipLister) ListMemberships(ctx context.Context, project string) ([]*gkehub.Membership, error) {
+	return l, nil
+}
+
+func TestFindMemberships(t *testing.T) {
+	t.Parallel()
+
+	lister := fakeMembershipLister{
+		{Name: "projects/123/locations/global/memberships/eks", State: &gkehub.MembershipState{Code: "READY"}},
+		{Name: "projects/123/locations/global/memberships/creating", State: &gkehub.MembershipState{Code: "CREATING"}},
+		{Name: "projects/123/locations/us-east1/memberships/onprem", State: &gkehub.MembershipState{Code: "READY"}},
+		{Name: "projects/123/locations/global/memberships/unknown"},
+	}
+
+	memberships, err := findMemberships(context.Background(), lister, "project")
+	if err != nil {
+		t.Fatalf("Could not find memberships: %v", err)
+	}
+	ids := []string{}
+	for _, m := range memberships {
+		ids = append(ids, m.ID())
+	}
+	if !reflect.DeepEqual(ids, []string{"eks", "onprem"}) {
+		t.Fatalf("Expected only ready memberships, got %v", ids)
+	}
+}
+
+func TestMembershipsToScrapeConfigs(t *testing.T) {
+	t.Parallel()
+
+	memberships := []hubMembership{{Name: "projects/123/locations/global/memberships/eks"}}
+	roles := map[string]Role{"pod": builtinRoles()["pod"]}
+	scs := membershipsToScrapeConfigs(testConfigOptions(), roles, memberships, "/var/run/secrets/gateway-token")
+	if len(scs) != 1 {
+		t.Fatalf("Expected a single scrape config, got %+v", scs)
+	}
+
+	data, err := yaml.Marshal(scs[0])
+	if err != nil {
+		t.Fatalf("Could not marshal scrape config: %v", err)
+	}
+	for _, e := range []string{
+		"job_name: kubernetes_hub_global_eks_pod",
+		"- https://connectgateway.googleapis.com/v1/projects/123/locations/global/gkeMemberships/eks",
+		"bearer_token_file: /var/run/secrets/gateway-token",
+	} {
+		if !strings.Contains(string(data), e) {
+			t.Fatalf("Expected %q in output\nGot: %s", e, data)
+		}
+	}
+	if strings.Contains(string(data), "basic_auth") {
+		t.Fatalf("Expected no basic auth for a membership\nGot: %s", data)
+	}
+}
+
+func TestMembershipsToScrapeConfigsGatewayTargets(t *testing.T) {
+	t.Parallel()
+
+	memberships := []hubMembership{{Name: "projects/123/locations/global/memberships/eks"}}
+	scs := membershipsToScrapeConfigs(testConfigOptions(), builtinRoles(), memberships, "/var/run/secrets/gateway-token")
+	jobs := map[string]ScrapeConfig{}
+	for _, sc := range scs {
+		jobs[sc.KubernetesSDConfigs[0].Role] = sc
+	}
+	gateway := "/v1/projects/123/locations/global/gkeMemberships/eks"
+
+	cases := []struct {
+		role   string
+		labels map[string]string
+		path   string // empty if the target is dropped
+	}{
+		{
+			role: "apiserver",
+			labels: map[string]string{
+				"__address__":      "10.0.0.1:443",
+				"__metrics_path__": "/metrics",
+			},
+			path: gateway + "/metrics",
+		},
+		{
+			role: "node",
+			labels: map[string]string{
+				"__address__":                 "10.0.0.5:10250",
+				"__metrics_path__":            "/metrics",
+				"__meta_kubernetes_node_name": "node-1",
+			},
+			path: gateway + "/api/v1/nodes/node-1/proxy/metrics",
+		},
+		{
+			role: "pod",
+			labels: map[string]string{
+				"__address__":                 "10.1.2.3:8080",
+				"__metrics_path__":            "/metrics",
+				"__meta_kubernetes_namespace": "default",
+				"__meta_kubernetes_pod_name":  "web-1",
+				"__meta_kubernetes_pod_annotation_prometheus_io_scrape": "true",
+				"__meta_kubernetes_pod_annotation_prometheus_io_port":   "9102",
+				"__meta_kubernetes_pod_annotation_prometheus_io_path":   "/stats",
+			},
+			path: gateway + "/api/v1/namespaces/default/pods/web-1:9102/proxy/stats",
+		},
+		{
+			role: "endpoint",
+			labels: map[string]string{
+				"__address__":                 "10.1.2.3:8080",
+				"__metrics_path__":            "/metrics",
+				"__meta_kubernetes_namespace": "default",
+				"__meta_kubernetes_pod_name":  "web-1",
+				"__meta_kubernetes_service_annotation_prometheus_io_scrape": "true",
+			},
+			path: gateway + "/api/v1/namespaces/default/pods/web-1:8080/proxy/metrics",
+		},
+		{
+			role: "endpoint",
+			labels: map[string]string{
+				"__address__":                 "10.1.2.3:8080",
+				"__metrics_path__":            "/metrics",
+				"__meta_kubernetes_namespace": "default",
+				"__meta_kubernetes_service_annotation_prometheus_io_scrape": "true",
+			},
+		},
+	}
+	for _, c := range cases {
+		sc := jobs[c.role]
+		if sc.Scheme != "https" || sc.BearerTokenFile != "/var/run/secrets/gateway-token" {
+			t.Errorf("%v: expected the job to scrape over https with the bearer token, got scheme %q and token %q", c.role, sc.Scheme, sc.BearerTokenFile)
+		}
+		out, kept := relabelTarget(c.labels, sc.RelabelConfigs)
+		if c.path == "" {
+			if kept {
+				t.Errorf("%v: expected %v to be dropped, got %v", c.role, c.labels, out)
+			}
+			continue
+		}
+		if !kept {
+			t.Errorf("%v: expected %v to be kept", c.role, c.labels)
+			continue
+		}
+		if out["__address__"] != "connectgateway.googleapis.com:443" || out["__metrics_path__"] != c.path || out["__scheme__"] != "https" {
+			t.Errorf("%v: expected https://connectgateway.googleapis.com:443%v, got %v://%v%v", c.role, c.path, out["__scheme__"], out["__address__"], out["__metrics_path__"])
+		}
+	}
+
+	// Services are probed by the blackbox exporter, which is reached directly
+	if sc := jobs["service"]; sc.Scheme != "" || sc.BearerTokenFile != "" {
+		t.Errorf("Expected the service job to be left to the blackbox exporter, got scheme %q and token %q", sc.Scheme, sc.BearerTokenFile)
+	}
+}
+
+func TestMembershipsToScrapeConfigsSameID(t *testing.T) {
+	t.Parallel()
+
+	memberships := []hubMembership{
+		{Name: "projects/123/locations/global/memberships/prod"},
+		{Name: "projects/123/locations/us-east1/memberships/prod"},
+	}
+	roles := map[string]Role{"pod": builtinRoles()["pod"]}
+	scs := membershipsToScrapeConfigs(testConfigOptions(), roles, memberships, "/var/run/secrets/gateway-token")
+	if len(scs) != 2 || scs[0].JobName == scs[1].JobName {
+		t.Fatalf("Expected distinct jobs for memberships in different locations, got %+v", scs)
+	}
+	if u := scs[1].KubernetesSDConfigs[0].APIServers[0]; u != "https://connectgateway.googleapis.com/v1/projects/123/locations/us-east1/gkeMemberships/prod" {
+		t.Fatalf("Unexpected gateway URL %v", u)
+	}
+}
+
+func TestMembershipListEqual(t *testing.T) {
+	t.Parallel()
+
+	a := []hubMembership{{Name: "a"}, {Name: "b"}}
+	if !membershipListEqual(a, []hubMembership{{Name: "b"}, {Name: "a"}}) {
+		t.Fatalf("Expected memberships in a different order to be equal")
+	}
+	if membershipListEqual(a, []hubMembership{{Name: "a"}, {Name: "c"}}) {
+		t.Fatalf("Expected different memberships to differ")
+	}
+}
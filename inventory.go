@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+
+	container "google.golang.org/api/container/v1"
+)
+
+// inventoryCluster is what is recorded for each cluster in the inventory
+type inventoryCluster struct {
+	Name       string     `json:"name"`
+	Project    string     `json:"project"`
+	Location   string     `json:"location"`
+	Endpoint   string     `json:"endpoint"`
+	Status     string     `json:"status"`
+	CertExpiry *time.Time `json:"certExpiry,omitempty"`
+}
+
+// clusterInventory returns the inventory of clusters, taking the project of each from its self
+// link, or defaultProject if it has none
+func clusterInventory(clusters []*container.Cluster, defaultProject string) []inventoryCluster {
+	inventory := make([]inventoryCluster, 0, len(clusters))
+	for _, c := range clusters {
+		project := selfLinkProject(c.SelfLink)
+		if project == "" {
+			project = defaultProject
+		}
+		inventory = append(inventory, inventoryCluster{
+			Name:       c.Name,
+			Project:    project,
+			Location:   clusterLocation(c),
+			Endpoint:   clusterEndpoint(c, preferPrivateEndpoint),
+			Status:     c.Status,
+			CertExpiry: clusterCertExpiry(c),
+		})
+	}
+	return inventory
+}
+
+// clusterCertExpiry returns when the first of a cluster's ca and client certs expires, or nil if
+// neither could be parsed
+func clusterCertExpiry(c *container.Cluster) *time.Time {
+	if c.MasterAuth == nil {
+		return nil
+	}
+	var expiry *time.Time
+	for _, b64Cert := range []string{c.MasterAuth.ClusterCaCertificate, c.MasterAuth.ClientCertificate} {
+		cert, err := base64.StdEncoding.DecodeString(b64Cert)
+		if err != nil {
+			continue
+		}
+		notAfter, err := certNotAfter(cert)
+		if err != nil {
+			continue
+		}
+		if expiry == nil || notAfter.Before(*expiry) {
+			expiry = &notAfter
+		}
+	}
+	return expiry
+}
+
+// writeInventory writes inventory to fname as JSON. As it may be read at any time, the file is
+// written alongside and renamed into place.
+func writeInventory(fname string, inventory []inventoryCluster) error {
+	data, err := json.MarshalIndent(inventory, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "could not marshal inventory")
+	}
+	err = os.MkdirAll(filepath.Dir(fname), os.FileMode(dirMode))
+	if err != nil {
+		return errors.Wrap(err, "could not create inventory directory")
+	}
+	tmp := fname + ".tmp"
+	err = ioutil.WriteFile(tmp, append(data, '\n'), 0644)
+	if err != nil {
+		return errors.Wrapf(err, "could not write %v", tmp)
+	}
+	return errors.Wrapf(os.Rename(tmp, fname), "could not rename %v to %v", tmp, fname)
+}
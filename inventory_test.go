@@ -0,0 +1,61 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	container "google.golang.org/api/container/v1"
+)
+
+func TestWriteInventory(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "gkesd-inventory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	clusters := []*container.Cluster{
+		{
+			Name:     "prod",
+			Endpoint: "10.0.0.1",
+			Location: "europe-west1",
+			Status:   "RUNNING",
+			SelfLink: "https://container.googleapis.com/v1/projects/service-a/locations/europe-west1/clusters/prod",
+		},
+		{Name: "dev", Endpoint: "10.0.0.2", Zone: "europe-west1-b", Status: "RECONCILING"},
+	}
+
+	fname := filepath.Join(dir, "inventory", "clusters.json")
+	if err := writeInventory(fname, clusterInventory(clusters, "host")); err != nil {
+		t.Fatalf("Could not write inventory: %v", err)
+	}
+
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `[
+  {
+    "name": "prod",
+    "project": "service-a",
+    "location": "europe-west1",
+    "endpoint": "10.0.0.1",
+    "status": "RUNNING"
+  },
+  {
+    "name": "dev",
+    "project": "host",
+    "location": "europe-west1-b",
+    "endpoint": "10.0.0.2",
+    "status": "RECONCILING"
+  }
+]
+`
+	if string(data) != expected {
+		t.Fatalf("Difference in expected inventory\nGot:\n%v\nExpected:\n%v\n", string(data), expected)
+	}
+}
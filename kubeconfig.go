@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+
+	container "google.golang.org/api/container/v1"
+)
+
+type Kubeconfig struct {
+	APIVersion     string                   `yaml:"apiVersion"`
+	Kind           string                   `yaml:"kind"`
+	Clusters       []KubeconfigClusterEntry `yaml:"clusters"`
+	Users          []KubeconfigUserEntry    `yaml:"users"`
+	Contexts       []KubeconfigContextEntry `yaml:"contexts"`
+	CurrentContext string                   `yaml:"current-context"`
+}
+
+type KubeconfigClusterEntry struct {
+	Name    string            `yaml:"name"`
+	Cluster KubeconfigCluster `yaml:"cluster"`
+}
+
+type KubeconfigCluster struct {
+	Server                   string `yaml:"server"`
+	CertificateAuthorityData string `yaml:"certificate-authority-data,omitempty"`
+}
+
+type KubeconfigUserEntry struct {
+	Name string         `yaml:"name"`
+	User KubeconfigUser `yaml:"user"`
+}
+
+type KubeconfigUser struct {
+	ClientCertificateData string `yaml:"client-certificate-data,omitempty"`
+	ClientKeyData         string `yaml:"client-key-data,omitempty"`
+	Token                 string `yaml:"token,omitempty"`
+	Username              string `yaml:"username,omitempty"`
+	Password              string `yaml:"password,omitempty"`
+}
+
+type KubeconfigContextEntry struct {
+	Name    string            `yaml:"name"`
+	Context KubeconfigContext `yaml:"context"`
+}
+
+type KubeconfigContext struct {
+	Cluster string `yaml:"cluster"`
+	User    string `yaml:"user"`
+}
+
+// clusterKubeconfig assembles a kubeconfig for accessing the cluster with its master auth
+// credentials, at the endpoint chosen by opts. The cert material from the API is already base64
+// encoded, as kubeconfig expects.
+func clusterKubeconfig(opts configOptions, cluster *container.Cluster) Kubeconfig {
+	user := KubeconfigUser{}
+	if hasClientCert(cluster) {
+		user.ClientCertificateData = cluster.MasterAuth.ClientCertificate
+		user.ClientKeyData = cluster.MasterAuth.ClientKey
+	} else if cluster.MasterAuth != nil {
+		user.Username = cluster.MasterAuth.Username
+		user.Password = cluster.MasterAuth.Password
+	}
+
+	ca := ""
+	if cluster.MasterAuth != nil {
+		ca = cluster.MasterAuth.ClusterCaCertificate
+	}
+
+	return Kubeconfig{
+		APIVersion: "v1",
+		Kind:       "Config",
+		Clusters: []KubeconfigClusterEntry{
+			{
+				Name: cluster.Name,
+				Cluster: KubeconfigCluster{
+					Server:                   "https://" + clusterEndpoint(cluster, opts.PreferPrivateEndpoint),
+					CertificateAuthorityData: ca,
+				},
+			},
+		},
+		Users: []KubeconfigUserEntry{
+			{
+				Name: cluster.Name,
+				User: user,
+			},
+		},
+		Contexts: []KubeconfigContextEntry{
+			{
+				Name: cluster.Name,
+				Context: KubeconfigContext{
+					Cluster: cluster.Name,
+					User:    cluster.Name,
+				},
+			},
+		},
+		CurrentContext: cluster.Name,
+	}
+}
+
+// kubeconfigPath returns the location of a cluster's kubeconfig within dir
+func kubeconfigPath(dir, clusterName string) string {
+	return fmt.Sprintf("%v/%v-kubeconfig.yml", dir, clusterName)
+}
+
+func writeKubeconfigs(outDir string, opts configOptions, clusters []*container.Cluster) error {
+	for _, cluster := range clusters {
+		data, err := yaml.Marshal(clusterKubeconfig(opts, cluster))
+		if err != nil {
+			return errors.Wrapf(err, "could not marshal kubeconfig for cluster %v", cluster.Name)
+		}
+		err = writeFileRetrying(kubeconfigPath(outDir, cluster.Name), data, os.FileMode(certFileMode))
+		if err != nil {
+			return errors.Wrapf(err, "could not write kubeconfig for cluster %v", cluster.Name)
+		}
+	}
+	return nil
+}
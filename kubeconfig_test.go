@@ -0,0 +1,80 @@
+package main
+
+import (
+	"testing"
+
+	container "google.golang.org/api/container/v1"
+	"gopkg.in/yaml.v2"
+)
+
+func TestClusterKubeconfig(t *testing.T) {
+	t.Parallel()
+
+	cluster := &container.Cluster{
+		Name:     "test",
+		Endpoint: "10.0.0.1",
+		MasterAuth: &container.MasterAuth{
+			ClusterCaCertificate: "Y2E=",
+			ClientCertificate:    "Y2VydA==",
+			ClientKey:            "a2V5",
+		},
+	}
+
+	data, err := yaml.Marshal(clusterKubeconfig(configOptions{}, cluster))
+	if err != nil {
+		t.Fatalf("Could not marshal kubeconfig: %v", err)
+	}
+
+	result := Kubeconfig{}
+	if err := yaml.Unmarshal(data, &result); err != nil {
+		t.Fatalf("Could not unmarshal kubeconfig: %v", err)
+	}
+
+	if result.CurrentContext != "test" {
+		t.Fatalf("Expected current-context test, got %v", result.CurrentContext)
+	}
+	if server := result.Clusters[0].Cluster.Server; server != "https://10.0.0.1" {
+		t.Fatalf("Expected server https://10.0.0.1, got %v", server)
+	}
+	if ca := result.Clusters[0].Cluster.CertificateAuthorityData; ca != "Y2E=" {
+		t.Fatalf("Expected certificate-authority-data Y2E=, got %v", ca)
+	}
+	user := result.Users[0].User
+	if user.ClientCertificateData != "Y2VydA==" || user.ClientKeyData != "a2V5" {
+		t.Fatalf("Expected client cert data to be set, got %+v", user)
+	}
+	if user.Username != "" || user.Password != "" {
+		t.Fatalf("Expected no basic auth when client certs are present, got %+v", user)
+	}
+}
+
+func TestClusterKubeconfigPrivateEndpoint(t *testing.T) {
+	t.Parallel()
+
+	cluster := &container.Cluster{
+		Name:     "test",
+		Endpoint: "10.0.0.1",
+		PrivateClusterConfig: &container.PrivateClusterConfig{
+			PrivateEndpoint: "172.16.0.2",
+		},
+	}
+
+	tests := []struct {
+		name     string
+		opts     configOptions
+		expected string
+	}{
+		{"public", configOptions{}, "https://10.0.0.1"},
+		{"private", configOptions{PreferPrivateEndpoint: true}, "https://172.16.0.2"},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			kubeconfig := clusterKubeconfig(tt.opts, cluster)
+			if server := kubeconfig.Clusters[0].Cluster.Server; server != tt.expected {
+				t.Fatalf("Expected server %v, got %v", tt.expected, server)
+			}
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// semaphore bounds how many operations run at once. A nil semaphore doesn't bound anything.
+type semaphore chan struct{}
+
+// newSemaphore returns a semaphore allowing n operations at once, or nil if n isn't positive
+func newSemaphore(n int) semaphore {
+	if n <= 0 {
+		return nil
+	}
+	return make(semaphore, n)
+}
+
+// Acquire blocks until a slot is free, or ctx is done
+func (s semaphore) Acquire(ctx context.Context) error {
+	if s == nil {
+		return nil
+	}
+	select {
+	case s <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Release frees a slot taken by Acquire
+func (s semaphore) Release() {
+	if s == nil {
+		return
+	}
+	<-s
+}
+
+// forEachLimited calls f concurrently for each i from 0 to n-1, each call holding a slot of
+// limit, and returns the error of each call in order
+func forEachLimited(ctx context.Context, limit semaphore, n int, f func(i int) error) []error {
+	errs := make([]error, n)
+	wg := sync.WaitGroup{}
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = limit.Acquire(ctx)
+			if errs[i] != nil {
+				return
+			}
+			defer limit.Release()
+			errs[i] = f(i)
+		}(i)
+	}
+	wg.Wait()
+	return errs
+}
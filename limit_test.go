@@ -0,0 +1,60 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+func TestForEachLimited(t *testing.T) {
+	t.Parallel()
+
+	var running, peak int32
+	limit := newSemaphore(3)
+	errs := forEachLimited(context.Background(), limit, 20, func(i int) error {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			p := atomic.LoadInt32(&peak)
+			if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		if i == 7 {
+			return errors.New("boom")
+		}
+		return nil
+	})
+	if peak > 3 {
+		t.Fatalf("Expected at most 3 calls at once, got %v", peak)
+	}
+	for i, err := range errs {
+		if (err != nil) != (i == 7) {
+			t.Fatalf("Expected only call 7 to fail, call %v got %v", i, err)
+		}
+	}
+
+	// A cancelled context fails calls still waiting for a slot
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	full := newSemaphore(1)
+	full.Acquire(context.Background())
+	errs = forEachLimited(ctx, full, 2, func(i int) error { return nil })
+	for i, err := range errs {
+		if err != context.Canceled {
+			t.Fatalf("Expected call %v to be cancelled, got %v", i, err)
+		}
+	}
+
+	// No limit runs everything
+	errs = forEachLimited(context.Background(), newSemaphore(0), 5, func(i int) error { return nil })
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("Expected call %v to succeed, got %v", i, err)
+		}
+	}
+}
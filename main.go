@@ -1,12 +1,23 @@
 package main
 
 import (
+	"bytes"
+	"crypto/x509"
 	"encoding/base64"
+	"encoding/pem"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math/rand"
 	"net/http"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
 	"time"
 
 	log "github.com/golang/glog"
@@ -15,146 +26,754 @@ import (
 	"golang.org/x/net/context"
 	"golang.org/x/net/context/ctxhttp"
 
+	"cloud.google.com/go/compute/metadata"
 	"github.com/fsnotify/fsnotify"
 	"gopkg.in/yaml.v2"
 
-	google "golang.org/x/oauth2/google"
-	compute "google.golang.org/api/compute/v1"
 	container "google.golang.org/api/container/v1"
 )
 
+// version is set at build time
+var version = "dev"
+
 var (
 	configInputFile  = "/etc/gke-input.yml"
 	configOutputFile = "/etc/gke-output.yml"
 
-	prometheusAddress = "http://prometheus:9090"
+	outputFormat      = "prometheus"
+	operatorOutputDir = "/etc/gke-scrapeconfigs"
+	operatorNamespace = ""
+
+	stdinOnce sync.Once
+	stdinData []byte
+	stdinErr  error
+
+	prometheusAddresses = stringSliceFlag{"http://prometheus:9090"}
+	reloadTimeout       = time.Second * 30
+	reloadMaxBackoff    = time.Second * 10
+	reloadMethod        = http.MethodPost
+	reloadRequireAll    = false
+	reloaderName        = "prometheus-http"
+	reloadPIDFile       = ""
+	minReloadInterval   = time.Duration(0)
+	promtoolPath        = ""
+
+	backoffInitial = time.Second
+	backoffFactor  = 1.1
+	backoffMax     = time.Second * 10
+	backoffJitter  = 0.0
 
 	certOutDir       = "/etc/gke-certs"
 	certReferenceDir = "/etc/gke-certs"
 
+	configFileMode = fileModeFlag(0600)
+	certFileMode   = fileModeFlag(0600)
+	dirMode        = fileModeFlag(0755)
+
+	certWriteConcurrency = 8
+	concurrency          = 16
+	opsLimit             semaphore
+
+	caBundle  = false
+	tlsCAOnly = false
+
+	basicAuthUsePasswordFile = false
+
+	certFilenameTemplate = ""
+	certFilenameTmpl     *template.Template
+
+	certReferenceTemplate = ""
+	certReferenceTmpl     *template.Template
+
+	basicAuthPasswordFileTemplate = ""
+	basicAuthPasswordFileTmpl     *template.Template
+
+	certExpiryWarning = time.Hour * 24 * 14
+
 	gcpProject   = ""
+	gcpUserAgent = "prometheus_gke_sd/" + version
+
+	gcpContainerEndpoint = ""
+	gcpComputeEndpoint   = ""
+
 	pollInterval = time.Second * 10
+	pollJitter   = time.Duration(0)
 
 	retryInterval = time.Second * 30
 
+	failOnPartial = false
+
+	releaseChannels   = stringSliceFlag{}
+	clusterNetwork    = ""
+	clusterSubnetwork = ""
+
+	pinnedClusters = stringSliceFlag{}
+
+	serviceProjects = stringSliceFlag{}
+
+	discoverHubMemberships = false
+	hubBearerTokenFile     = ""
+	hubBearerTokenRefresh  = false
+	hubBearerTokenMargin   = 5 * time.Minute
+
+	preferPrivateEndpoint = false
+
+	clusterLabel        = ""
+	discoverAllClusters = false
+	scrapeIntervalLabel = "prometheus-interval"
+
 	metricsAddr = ":8080"
 
+	webTLSCertFile  = ""
+	webTLSKeyFile   = ""
+	webClientCAFile = ""
+
+	verbosity = 0
+
+	textfileOutput  = ""
+	inventoryOutput = ""
+
+	scrapeProxyURL = ""
+
+	rolesFiles = stringSliceFlag{}
+	rolesMerge = rolesMergeOverride
+
+	namespaceAllowlist = stringSliceFlag{}
+	namespaceDenylist  = stringSliceFlag{}
+
+	staticTargetLabels = labelsFlag{}
+	stampGeneration    = false
+
+	nodePools              = stringSliceFlag{}
+	nodeMetricsPort        = 10250
+	nodeScrapeVia          = "kubelet"
+	nodeRequireScrapeLabel = false
+
+	clusterLabelVia    = stringSliceFlag{}
+	clusterTargetLabel = false
+	clusterMetricLabel = false
+
+	podNamedPorts = false
+
+	strict = false
+
+	checkOnly = false
+	diffOnly  = false
+
+	refuseEmpty = false
+	maxClusters = 0
+
+	writeKubeconfig = false
+	sdKubeconfig    = false
+
+	waitForInput = false
+
+	templateInput = false
+
+	extraScrapeConfigsDir = ""
+	configSizeWarn        = 0
+	stripGeneratedJobs    = false
+
+	skipInitialSync = false
+	startupDelay    = time.Duration(0)
+
 	clusterCount = prometheus.NewGauge(prometheus.GaugeOpts{
 		Name: "gkesd_clusters",
 		Help: "Number of clusters discovered",
 	})
-	syncDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
-		Name: "gkesd_sync_duration_seconds",
-		Help: "Duration of the GKE api to prometheus config sync operation",
-	})
-	syncResult = prometheus.NewCounterVec(prometheus.CounterOpts{
+	syncDurationBuckets = floatSliceFlag{1, 2.5, 5, 10, 15, 20, 30, 45, 60, 90, 120, 180}
+	syncDuration        prometheus.Histogram
+	phaseDuration       *prometheus.HistogramVec
+	syncResult          = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "gkesd_sync_count",
-		Help: "Count of the GKE api to prometheus config sync operation, labeled by result",
+		Help: "Count of the GKE api to prometheus config sync operation, labeled by result and the phase that failed",
+	}, []string{"result", "phase"})
+	scrapeConfigsGenerated = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "gkesd_scrape_configs_generated",
+		Help: "Number of scrape configs generated for discovered clusters",
+	})
+	scrapeConfigsTotal = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "gkesd_scrape_configs_total",
+		Help: "Number of scrape configs in the output config, including those from the input config",
+	})
+	configBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "gkesd_config_bytes",
+		Help: "Size in bytes of the last generated config",
+	})
+	reloadDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gkesd_reload_duration_seconds",
+		Help:    "Duration of reloading a Prometheus server, including retries, labeled by outcome",
+		Buckets: prometheus.ExponentialBuckets(0.05, 2, 12),
+	}, []string{"outcome"})
+	reloadResult = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gkesd_reload_total",
+		Help: "Count of Prometheus reloads, labeled by endpoint and result",
+	}, []string{"endpoint", "result"})
+	emptyDiscoveries = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "gkesd_empty_discovery_total",
+		Help: "Count of discoveries that found no clusters when clusters were previously found",
+	})
+	certExpiry = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gkesd_cluster_cert_expiry_timestamp_seconds",
+		Help: "Unix time at which a cluster's certificate expires, labeled by cluster and cert type",
+	}, []string{"cluster", "type"})
+	discoveryOverLimit = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "gkesd_discovery_over_limit_total",
+		Help: "Count of discoveries aborted for finding more clusters than -max-clusters",
+	})
+	discoveryErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gkesd_discovery_errors_total",
+		Help: "Count of errors listing zones or getting clusters during discovery, labeled by project and reason",
+	}, []string{"project", "reason"})
+	configWrites = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "gkesd_config_writes_total",
+		Help: "Count of writes of the output config",
+	})
+	certWrites = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gkesd_cert_writes_total",
+		Help: "Count of cert files written, labeled by type",
+	}, []string{"type"})
+	clusterCertErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gkesd_cluster_cert_errors_total",
+		Help: "Count of failures to write a cluster's certificates, labeled by cluster",
+	}, []string{"cluster"})
+	tokenRefreshes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gkesd_token_refresh_total",
+		Help: "Count of refreshes of the hub bearer token, labeled by result",
 	}, []string{"result"})
+	tokenExpiry = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "gkesd_token_expiry_timestamp_seconds",
+		Help: "Unix time at which the hub bearer token last written expires",
+	})
+	watchEvents = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "gkesd_watch_events_total",
+		Help: "Count of filesystem events received for watched input files, before debouncing",
+	})
+	watchTriggers = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "gkesd_watch_triggers_total",
+		Help: "Count of syncs triggered by changes to watched input files, after debouncing",
+	})
 )
 
 const (
 	debounceDuration = time.Second * 5
 
-	reloadInterval = time.Second
-	reloadBackoff  = 1.1
+	inputWaitInterval = time.Second
 )
 
 func init() {
-	flag.StringVar(&configInputFile, "prometheus.config-input", configInputFile, "Prometheus config file to augment with GKE clusters")
+	flag.StringVar(&configInputFile, "prometheus.config-input", configInputFile, "Prometheus config file to augment with GKE clusters, '-' for stdin, or an http(s) URL")
+	flag.StringVar(&extraScrapeConfigsDir, "extra-scrape-configs-dir", extraScrapeConfigsDir, "Directory of *.yml files, each a list of scrape configs, to add to the output config")
+	flag.IntVar(&configSizeWarn, "config-size-warn", configSizeWarn, "Log a warning when the generated config is larger than this many bytes, 0 to never warn")
+	flag.BoolVar(&stripGeneratedJobs, "strip-generated-jobs", stripGeneratedJobs, "Drop scrape configs named like generated jobs from the input config, so a previous output can be used as input")
+	flag.BoolVar(&templateInput, "template-input", templateInput, "Execute the input config as a Go text/template, with environment variables available as {{ .NAME }}")
+	flag.BoolVar(&waitForInput, "wait-for-input", waitForInput, "Wait for the input config file to exist rather than exiting")
 	flag.StringVar(&configOutputFile, "prometheus.config-output", configOutputFile, "Location to write augmented prometheus config file")
-
-	flag.StringVar(&prometheusAddress, "prometheus.address", prometheusAddress, "Address of Prometheus server to reload")
+	flag.StringVar(&outputFormat, "output-format", outputFormat, "What to write for discovered clusters, prometheus for an augmented config or operator for Prometheus Operator ScrapeConfig manifests")
+	flag.StringVar(&operatorOutputDir, "operator.output-dir", operatorOutputDir, "Directory to write a file of ScrapeConfig manifests to for each cluster, with -output-format=operator")
+	flag.StringVar(&operatorNamespace, "operator.namespace", operatorNamespace, "Namespace of the ScrapeConfigs and secrets written with -output-format=operator")
+
+	flag.Var(&configFileMode, "file-mode", "Octal permissions of the output config file")
+	flag.Var(&certFileMode, "cert-mode", "Octal permissions of written certificate and kubeconfig files")
+	flag.Var(&dirMode, "dir-mode", "Octal permissions of output directories created if missing")
+
+	flag.Var(&prometheusAddresses, "prometheus.address", "Comma separated addresses of Prometheus servers to reload")
+	flag.BoolVar(&reloadRequireAll, "reload-require-all", reloadRequireAll, "Fail the sync if any Prometheus server fails to reload, rather than only if all do")
+	flag.StringVar(&reloaderName, "reloader", reloaderName, "How to reload after writing the config, one of "+strings.Join(reloaderNames, ", "))
+	flag.StringVar(&reloadPIDFile, "reloader.pid-file", reloadPIDFile, "File holding the PID of the process the signal reloader sends SIGHUP to")
+	flag.DurationVar(&reloadTimeout, "prometheus.reload-timeout", reloadTimeout, "Timeout for reloading Prometheus, including retries")
+	flag.DurationVar(&minReloadInterval, "prometheus.min-reload-interval", minReloadInterval, "Minimum time between reloads of Prometheus, changes within it are coalesced into one reload once it has passed")
+	flag.DurationVar(&reloadMaxBackoff, "prometheus.reload-max-backoff", reloadMaxBackoff, "Maximum time to wait between retries of a failed Prometheus reload")
+	flag.StringVar(&promtoolPath, "prometheus.promtool-path", promtoolPath, "Path of promtool, to check the syntax of each generated config with before putting it in place, empty to not check")
+	flag.StringVar(&reloadMethod, "prometheus.reload-method-http", reloadMethod, "HTTP method used to call the reload endpoint of each Prometheus")
+
+	flag.DurationVar(&backoffInitial, "retry.initial-backoff", backoffInitial, "Time to wait before the first retry of a failed reload, discovery or watch")
+	flag.Float64Var(&backoffFactor, "retry.backoff-factor", backoffFactor, "Factor to grow the wait by between each retry")
+	flag.DurationVar(&backoffMax, "retry.max-backoff", backoffMax, "Maximum time to wait between retries of a failed discovery or watch")
+	flag.Float64Var(&backoffJitter, "retry.backoff-jitter", backoffJitter, "Fraction, from 0 to 1, of each wait between retries to randomly adjust it by")
 
 	flag.StringVar(&certOutDir, "prometheus.cert.output-path", certOutDir, "Directory to write GKE certificates to")
 	flag.StringVar(&certReferenceDir, "prometheus.cert.reference-path", certReferenceDir, "Path in prometheus config to reference GKE certificates")
-	flag.StringVar(&gcpProject, "gcp.project", "", "GCP project to discover clusters in")
+	flag.IntVar(&certWriteConcurrency, "prometheus.cert.write-concurrency", certWriteConcurrency, "Number of clusters to write certificates for concurrently")
+	flag.IntVar(&concurrency, "concurrency", concurrency, "Maximum number of GCP calls and cert writes in flight at once, across all clusters and zones, 0 for no limit")
+	flag.BoolVar(&basicAuthUsePasswordFile, "basic-auth-use-password-file", basicAuthUsePasswordFile, "Write cluster basic auth passwords to files next to the certificates, referenced with password_file rather than inlined. Can't be used with -write-kubeconfig or -sd-kubeconfig")
+	flag.StringVar(&certFilenameTemplate, "cert-filename-template", certFilenameTemplate, "Go template of cert filenames, over .ClusterName, .Project, .Location and .Type, such as {{ .Project }}_{{ .Location }}_{{ .ClusterName }}-{{ .Type }}.pem. Defaults to <cluster>-<type>.pem. Password and kubeconfig files keep their default names")
+	flag.StringVar(&certReferenceTemplate, "cert-reference-template", certReferenceTemplate, "Go template of the path Prometheus reads each ca, cert and key from, over the same fields as -cert-filename-template, such as /certs/{{ .ClusterName }}/{{ .Type }}.pem, with a Type of ca-bundle for -cert.ca-bundle. Defaults to the written file within -prometheus.cert.reference-path")
+	flag.StringVar(&basicAuthPasswordFileTemplate, "basic-auth-password-file-template", basicAuthPasswordFileTemplate, "Go template of the password_file to reference for clusters with no basic auth password of their own, over .ClusterName, .Project and .Location like -cert-filename-template, such as /etc/secrets/{{ .ClusterName }}/password")
+	flag.BoolVar(&tlsCAOnly, "tls.ca-only", tlsCAOnly, "Only reference the ca cert in generated tls_configs, leaving out client certs")
+	flag.BoolVar(&caBundle, "cert.ca-bundle", caBundle, "Write the ca certs of all clusters to a single ca-bundle.pem rather than one file per cluster")
+	flag.DurationVar(&certExpiryWarning, "cert-expiry-warning", certExpiryWarning, "Log a warning when a cluster certificate expires within this long")
+	flag.BoolVar(&writeKubeconfig, "write-kubeconfig", writeKubeconfig, "Also write a kubeconfig for each cluster to the certificate output path")
+	flag.BoolVar(&sdKubeconfig, "sd-kubeconfig", sdKubeconfig, "Discover targets using each cluster's kubeconfig with kubeconfig_file, rather than api_servers and tls_config. Implies -write-kubeconfig.")
+	flag.StringVar(&gcpProject, "gcp.project", "", "GCP project to discover clusters in, defaults to the project from the GCE metadata server")
+	flag.Var(&serviceProjects, "gcp.service-projects", "Comma separated shared VPC service projects to discover clusters in, as well as -gcp.project. Cluster names are prefixed with their project when set.")
+	flag.StringVar(&gcpUserAgent, "gcp.user-agent", gcpUserAgent, "User-Agent to send with GCP api requests")
+	flag.StringVar(&gcpContainerEndpoint, "gcp.container-endpoint", gcpContainerEndpoint, "Base URL of the GKE api, defaults to the public api")
+	flag.StringVar(&gcpComputeEndpoint, "gcp.compute-endpoint", gcpComputeEndpoint, "Base URL of the compute api, defaults to the public api")
 	flag.DurationVar(&pollInterval, "poll-interval", pollInterval, "Interval to poll for new GKE clusters at")
+	flag.DurationVar(&pollJitter, "poll-jitter", pollJitter, "Maximum random amount to add to or remove from each poll interval")
+
+	flag.BoolVar(&preferPrivateEndpoint, "prefer-private-endpoint", preferPrivateEndpoint, "Reach clusters at their private endpoint, where they have one, rather than their public endpoint")
+	flag.StringVar(&clusterLabel, "gcp.cluster-label", clusterLabel, "GCP label, as key=value or just key, that clusters must have to be discovered, such as prometheus-scrape=true, empty to discover every cluster")
+	flag.StringVar(&scrapeIntervalLabel, "gcp.scrape-interval-label", scrapeIntervalLabel, "GCP label whose value, a duration like 30s, sets the scrape interval of a cluster's jobs, empty to ignore cluster labels")
+	flag.BoolVar(&discoverAllClusters, "discover-all-clusters", discoverAllClusters, "Discover every cluster, regardless of -gcp.cluster-label")
+	flag.Var(&releaseChannels, "gcp.release-channels", "Comma separated GKE release channels to discover clusters on, with static for clusters not on a channel, defaults to all clusters")
+	flag.StringVar(&clusterNetwork, "gcp.network", clusterNetwork, "Only discover clusters on this VPC network, by name or resource path")
+	flag.StringVar(&clusterSubnetwork, "gcp.subnetwork", clusterSubnetwork, "Only discover clusters on this subnetwork, by name or resource path")
+	flag.Var(&pinnedClusters, "gcp.clusters", "Comma separated clusters, as project/location/name, to fetch directly rather than listing and filtering the clusters in -gcp.project")
+	flag.BoolVar(&discoverHubMemberships, "discover-hub-memberships", discoverHubMemberships, "Also discover clusters registered to the GKE Hub fleet of -gcp.project, reaching them through the connect gateway")
+	flag.StringVar(&hubBearerTokenFile, "hub.bearer-token-file", hubBearerTokenFile, "File of the bearer token Prometheus authenticates to the connect gateway with, required by -discover-hub-memberships")
+	flag.BoolVar(&hubBearerTokenRefresh, "hub.bearer-token-refresh", hubBearerTokenRefresh, "Write -hub.bearer-token-file with an access token for the default credentials, refreshing it before it expires")
+	flag.DurationVar(&hubBearerTokenMargin, "hub.bearer-token-refresh-margin", hubBearerTokenMargin, "How long before the bearer token expires to refresh it")
+	flag.BoolVar(&failOnPartial, "fail-on-partial", failOnPartial, "Fail the sync when clusters can't be listed in some zones or projects, or their certs can't be written, rather than continuing with the rest")
 
 	flag.DurationVar(&retryInterval, "gke.retry-interval", retryInterval, "The retry interval for the prometheus kubernetes discoverer")
 
+	flag.StringVar(&scrapeProxyURL, "scrape-proxy-url", scrapeProxyURL, "HTTP proxy for Prometheus to discover and scrape targets through, unless overridden by a role")
+
+	flag.Var(&rolesFiles, "roles-file", "Comma separated YAML files of roles to generate jobs for, overriding the built in roles of the same name")
+	flag.StringVar(&rolesMerge, "roles-merge", rolesMerge, "How a role defined in more than one roles file is merged, override for the later file's role to replace the earlier one, or append to append its relabel configs")
+
+	flag.Var(&namespaceAllowlist, "namespace-allowlist", "Comma separated namespaces to restrict all namespaced roles to, defaults to all namespaces")
+	flag.Var(&namespaceDenylist, "namespace-denylist", "Comma separated namespaces to exclude from all namespaced roles, applied after -namespace-allowlist")
+
+	flag.Var(&staticTargetLabels, "static-target-labels", "Comma separated key=value labels to set on every target of every generated job")
+	flag.BoolVar(&stampGeneration, "stamp-generation", stampGeneration, "Label every target of every generated job with the unix time of the sync that wrote it, as gkesd_generation")
+
+	flag.Var(&nodePools, "node-pool", "Comma separated GKE node pools to scrape nodes in, defaults to all pools")
+	flag.StringVar(&nodeScrapeVia, "node-scrape-via", nodeScrapeVia, "How to reach node metrics, either kubelet to scrape nodes directly or apiserver to scrape through the API server proxy")
+	flag.BoolVar(&nodeRequireScrapeLabel, "node-require-scrape-label", nodeRequireScrapeLabel, "Only scrape nodes labeled prometheus.io/scrape=true, like the annotation pods and services opt in with")
+	flag.BoolVar(&podNamedPorts, "pod-named-ports", podNamedPorts, "Let the pod role's prometheus.io/port annotation name a container port as well as give its number, requires Prometheus 2.41 or later")
+	flag.Var(&clusterLabelVia, "cluster-label-via", "Comma separated ways of setting the cluster label on every job, target to set it on targets and metric to set it on every scraped sample, which survives honor_labels. Only apiserver targets are labeled by default")
+	flag.IntVar(&nodeMetricsPort, "node-metrics-port", nodeMetricsPort, "Kubelet port to scrape node metrics from, any port other than the read-only 10255 is scraped over https with the cluster credentials")
+
 	flag.StringVar(&metricsAddr, "metrics.addr", metricsAddr, "Address to expose metrics endpoint on")
+	flag.StringVar(&webTLSCertFile, "web.tls-cert-file", webTLSCertFile, "Certificate to serve the HTTP endpoints over TLS with, along with -web.tls-key-file")
+	flag.StringVar(&webTLSKeyFile, "web.tls-key-file", webTLSKeyFile, "Key for -web.tls-cert-file")
+	flag.StringVar(&webClientCAFile, "web.client-ca-file", webClientCAFile, "CA to verify client certificates with, which are then required for /reload. Requires TLS.")
+	flag.StringVar(&textfileOutput, "textfile-output", textfileOutput, "Path of a node_exporter textfile collector .prom file to report each cluster's last sync to")
+	flag.StringVar(&inventoryOutput, "inventory-output", inventoryOutput, "Path to write a JSON inventory of the clusters in the config to each time the config is written")
+	flag.Var(&syncDurationBuckets, "metrics.sync-duration-buckets", "Comma separated histogram buckets, in seconds, for the sync duration metric")
+
+	flag.BoolVar(&skipInitialSync, "skip-initial-sync", skipInitialSync, "Don't sync at startup, waiting for the first poll or input change instead")
+	flag.DurationVar(&startupDelay, "startup-delay", startupDelay, "How long to wait before the initial sync, giving Prometheus time to start")
+	flag.BoolVar(&refuseEmpty, "refuse-empty", refuseEmpty, "Don't update the config when discovery finds no clusters but previously found some")
+	flag.IntVar(&maxClusters, "max-clusters", maxClusters, "Don't update the config when discovery finds more than this many clusters, 0 for no limit")
+	flag.BoolVar(&checkOnly, "check", checkOnly, "Validate the roles file and input config without contacting GCP, then exit")
+	flag.BoolVar(&diffOnly, "diff", diffOnly, "Print a diff from the current output config to the newly generated one without writing it, then exit")
+	flag.BoolVar(&strict, "strict", strict, "Exit on startup configuration problems that would otherwise only be logged")
+	flag.IntVar(&verbosity, "verbosity", verbosity, "Log verbosity, 2 logs each sync step and higher levels add detail")
 
 	prometheus.MustRegister(clusterCount)
-	prometheus.MustRegister(syncDuration)
 	prometheus.MustRegister(syncResult)
+	prometheus.MustRegister(clusterCertErrors)
+	prometheus.MustRegister(certExpiry)
+	prometheus.MustRegister(emptyDiscoveries)
+	prometheus.MustRegister(discoveryErrors)
+	prometheus.MustRegister(discoveryOverLimit)
+	prometheus.MustRegister(reloadResult)
+	prometheus.MustRegister(reloadDuration)
+	prometheus.MustRegister(configWrites)
+	prometheus.MustRegister(certWrites)
+	prometheus.MustRegister(scrapeConfigsGenerated)
+	prometheus.MustRegister(scrapeConfigsTotal)
+	prometheus.MustRegister(configBytes)
+	prometheus.MustRegister(tokenRefreshes)
+	prometheus.MustRegister(tokenExpiry)
+	prometheus.MustRegister(watchEvents)
+	prometheus.MustRegister(watchTriggers)
 }
 
 type PrometheusConfig struct {
+	Global        *GlobalConfig          `yaml:"global,omitempty"`
 	ScrapeConfigs []ScrapeConfig         `yaml:"scrape_configs"`
+	RemoteWrite   []RemoteWriteConfig    `yaml:"remote_write,omitempty"`
 	XXX           map[string]interface{} `yaml:",inline"`
 }
 
+type GlobalConfig struct {
+	ScrapeInterval     string                 `yaml:"scrape_interval,omitempty"`
+	ScrapeTimeout      string                 `yaml:"scrape_timeout,omitempty"`
+	EvaluationInterval string                 `yaml:"evaluation_interval,omitempty"`
+	ExternalLabels     map[string]string      `yaml:"external_labels,omitempty"`
+	XXX                map[string]interface{} `yaml:",inline"`
+}
+
+type RemoteWriteConfig struct {
+	URL string                 `yaml:"url"`
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
 type TLSConfig struct {
-	CAFile   string `yaml:"ca_file,omitempty"`
-	CertFile string `yaml:"cert_file,omitempty"`
-	KeyFile  string `yaml:"key_file,omitempty"`
+	CAFile             string                 `yaml:"ca_file,omitempty"`
+	CertFile           string                 `yaml:"cert_file,omitempty"`
+	KeyFile            string                 `yaml:"key_file,omitempty"`
+	InsecureSkipVerify bool                   `yaml:"insecure_skip_verify,omitempty"`
+	XXX                map[string]interface{} `yaml:",inline"`
 }
 type BasicAuth struct {
-	Username string `yaml:"username"`
-	Password string `yaml:"password"`
+	Username     string `yaml:"username,omitempty"`
+	Password     string `yaml:"password,omitempty"`
+	PasswordFile string `yaml:"password_file,omitempty"`
 }
 
 type KubeSDConfig struct {
-	APIServers    []string  `yaml:"api_servers"`
-	Role          string    `yaml:"role"`
-	InCluster     bool      `yaml:"in_cluster,omitempty"`
-	TLSConfig     TLSConfig `yaml:"tls_config,omitempty"`
-	RetryInterval string    `yaml:"retry_interval,omitempty"`
+	APIServers      []string               `yaml:"api_servers,omitempty"`
+	KubeconfigFile  string                 `yaml:"kubeconfig_file,omitempty"`
+	Role            string                 `yaml:"role"`
+	InCluster       bool                   `yaml:"in_cluster,omitempty"`
+	TLSConfig       TLSConfig              `yaml:"tls_config,omitempty"`
+	RetryInterval   string                 `yaml:"retry_interval,omitempty"`
+	ProxyURL        string                 `yaml:"proxy_url,omitempty"`
+	BearerTokenFile string                 `yaml:"bearer_token_file,omitempty"`
+	XXX             map[string]interface{} `yaml:",inline"`
 }
 
 type ScrapeConfig struct {
-	JobName             string                 `yaml:"job_name"`
-	KubernetesSDConfigs []KubeSDConfig         `yaml:"kubernetes_sd_configs,omitempty"`
-	RelabelConfigs      []RelabelConfig        `yaml:"relabel_configs,omitempty"`
-	BasicAuth           BasicAuth              `yaml:"basic_auth,omitempty"`
-	XXX                 map[string]interface{} `yaml:",inline"`
+	JobName              string                 `yaml:"job_name"`
+	ScrapeInterval       string                 `yaml:"scrape_interval,omitempty"`
+	HonorLabels          bool                   `yaml:"honor_labels,omitempty"`
+	HonorTimestamps      *bool                  `yaml:"honor_timestamps,omitempty"`
+	Scheme               string                 `yaml:"scheme,omitempty"`
+	MetricsPath          string                 `yaml:"metrics_path,omitempty"`
+	SampleLimit          uint                   `yaml:"sample_limit,omitempty"`
+	TargetLimit          uint                   `yaml:"target_limit,omitempty"`
+	ProxyURL             string                 `yaml:"proxy_url,omitempty"`
+	ScrapeProtocols      []string               `yaml:"scrape_protocols,omitempty"`
+	EnableHTTP2          *bool                  `yaml:"enable_http2,omitempty"`
+	FollowRedirects      *bool                  `yaml:"follow_redirects,omitempty"`
+	KubernetesSDConfigs  []KubeSDConfig         `yaml:"kubernetes_sd_configs,omitempty"`
+	RelabelConfigs       []RelabelConfig        `yaml:"relabel_configs,omitempty"`
+	MetricRelabelConfigs []RelabelConfig        `yaml:"metric_relabel_configs,omitempty"`
+	BasicAuth            *BasicAuth             `yaml:"basic_auth,omitempty"`
+	BearerTokenFile      string                 `yaml:"bearer_token_file,omitempty"`
+	TLSConfig            *TLSConfig             `yaml:"tls_config,omitempty"`
+	XXX                  map[string]interface{} `yaml:",inline"`
 }
 
 func main() {
 	flag.Parse()
-	if gcpProject == "" {
-		log.Error("Please supply a GCP Project")
+
+	// -verbosity only overrides glog's -v when given, so -v keeps working on its own
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "verbosity" {
+			flag.Set("v", strconv.Itoa(verbosity))
+		}
+	})
+
+	if checkOnly {
+		err := runCheck(context.Background(), configInputFile, rolesFiles, certReferenceDir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Check failed: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println("Check passed")
+		os.Exit(0)
+	}
+
+	if !discoverAllClusters && clusterLabel != "" && strings.SplitN(clusterLabel, "=", 2)[0] == "" {
+		log.Fatalf("-gcp.cluster-label must name a label, or be empty to discover every cluster")
+	}
+
+	if basicAuthUsePasswordFile && (writeKubeconfig || sdKubeconfig) {
+		log.Fatalf("-basic-auth-use-password-file can't be used with -write-kubeconfig or -sd-kubeconfig, as kubeconfigs hold passwords inline")
+	}
+
+	if err := validateBackoff(backoffInitial, backoffFactor, backoffMax, backoffJitter); err != nil {
+		log.Fatalf("Invalid -retry flags: %v", err)
+	}
+	if reloadMaxBackoff <= 0 {
+		log.Fatalf("-prometheus.reload-max-backoff must be positive")
+	}
+
+	for _, c := range pinnedClusters {
+		_, err := parseClusterRef(c)
+		if err != nil {
+			log.Fatalf("Invalid -gcp.clusters: %v", err)
+		}
+	}
+
+	for _, via := range clusterLabelVia {
+		switch via {
+		case "target":
+			clusterTargetLabel = true
+		case "metric":
+			clusterMetricLabel = true
+		default:
+			log.Fatalf("Invalid -cluster-label-via %v, must be target or metric", via)
+		}
+	}
+
+	if rolesMerge != rolesMergeOverride && rolesMerge != rolesMergeAppend {
+		log.Fatalf("-roles-merge must be %v or %v, not %v", rolesMergeOverride, rolesMergeAppend, rolesMerge)
+	}
+
+	if outputFormat != "prometheus" && outputFormat != "operator" {
+		log.Fatalf("-output-format must be prometheus or operator, not %v", outputFormat)
+	}
+	if outputFormat == "operator" && discoverHubMemberships {
+		log.Fatalf("-discover-hub-memberships is not supported with -output-format=operator")
+	}
+
+	if discoverHubMemberships && hubBearerTokenFile == "" {
+		log.Fatalf("-discover-hub-memberships requires -hub.bearer-token-file")
+	}
+	if hubBearerTokenRefresh && hubBearerTokenFile == "" {
+		log.Fatalf("-hub.bearer-token-refresh requires -hub.bearer-token-file")
+	}
+	if hubBearerTokenRefresh && hubBearerTokenMargin <= 0 {
+		log.Fatalf("-hub.bearer-token-refresh-margin must be positive")
+	}
+
+	opsLimit = newSemaphore(concurrency)
+
+	if promtoolPath != "" {
+		path, err := findPromtool(promtoolPath)
+		if err != nil {
+			log.Fatalf("Invalid -prometheus.promtool-path, configs can't be checked: %v", err)
+		}
+		promtoolPath = path
+	}
+
+	reloader, err := newReloader(reloaderName)
+	if err != nil {
+		log.Fatalf("Invalid -reloader: %v", err)
+	}
+
+	if _, err := http.NewRequest(reloadMethod, "http://localhost/-/reload", nil); err != nil {
+		log.Fatalf("Invalid -prometheus.reload-method-http: %v", err)
+	}
+
+	if certFilenameTemplate != "" {
+		tmpl, err := parseCertFilenameTemplate(certFilenameTemplate)
+		if err != nil {
+			log.Fatalf("Invalid -cert-filename-template: %v", err)
+		}
+		certFilenameTmpl = tmpl
+	}
+
+	if certReferenceTemplate != "" {
+		tmpl, err := parseCertFilenameTemplate(certReferenceTemplate)
+		if err != nil {
+			log.Fatalf("Invalid -cert-reference-template: %v", err)
+		}
+		certReferenceTmpl = tmpl
+	}
+
+	if basicAuthPasswordFileTemplate != "" {
+		tmpl, err := parsePasswordFileTemplate(basicAuthPasswordFileTemplate)
+		if err != nil {
+			log.Fatalf("Invalid -basic-auth-password-file-template: %v", err)
+		}
+		basicAuthPasswordFileTmpl = tmpl
+	}
+
+	if gcpProject == "" && len(pinnedClusters) == 0 {
+		// On GCE and GKE the project we're running in is the one we're most likely to want
+		project, err := metadata.ProjectID()
+		if err != nil {
+			log.Errorf("Please supply a GCP Project, could not get one from the metadata server: %v", err)
+			os.Exit(1)
+		}
+		log.Infof("Using GCP project %v from the metadata server", project)
+		gcpProject = project
+	}
+
+	if nodeScrapeVia != "kubelet" && nodeScrapeVia != "apiserver" {
+		log.Errorf("Unknown -node-scrape-via %q, must be kubelet or apiserver", nodeScrapeVia)
 		os.Exit(1)
 	}
 
+	roles, err := loadRoles(rolesFiles, rolesMerge)
+	if err != nil {
+		log.Fatalf("Could not load roles: %v", err)
+	}
+
+	if diffOnly {
+		if outputFormat != "prometheus" {
+			log.Fatalf("-diff is only supported with -output-format=prometheus")
+		}
+		err := runDiff(context.Background(), roles)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Diff failed: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	staged := []string{certOutDir, filepath.Dir(configOutputFile)}
+	if outputFormat == "operator" {
+		staged[1] = operatorOutputDir
+	}
+	for _, dir := range staged {
+		err = removeStaleStages(dir)
+		if err != nil {
+			log.Fatalf("Could not clean up after an unfinished sync: %v", err)
+		}
+	}
+
+	err = validateCertDirs(certOutDir, certReferenceDir, readMountPoints())
+	if err != nil {
+		if strict {
+			log.Fatalf("Invalid certificate paths: %v", err)
+		}
+		log.Warningf("Possible certificate path misconfiguration: %v", err)
+	}
+	log.Infof("Prometheus will read certificates from %v", certPath(certReferenceDir, "<cluster>", "{ca,cert,key}"))
+
 	ctx := context.Background()
 
+	// Buckets are configurable, so the histogram can only be created once flags are parsed
+	syncDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "gkesd_sync_duration_seconds",
+		Help:    "Duration of the GKE api to prometheus config sync operation",
+		Buckets: syncDurationBuckets,
+	})
+	prometheus.MustRegister(syncDuration)
+	phaseDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gkesd_discovery_duration_seconds",
+		Help:    "Duration of each phase of the sync operation, labeled by phase",
+		Buckets: syncDurationBuckets,
+	}, []string{"phase"})
+	prometheus.MustRegister(phaseDuration)
+
+	if (webTLSCertFile == "") != (webTLSKeyFile == "") {
+		log.Fatalf("-web.tls-cert-file and -web.tls-key-file must be given together")
+	}
+	if webClientCAFile != "" && webTLSCertFile == "" {
+		log.Fatalf("-web.client-ca-file requires -web.tls-cert-file and -web.tls-key-file")
+	}
+	tlsConfig, err := webTLSConfig(webClientCAFile)
+	if err != nil {
+		log.Fatalf("Could not configure TLS: %v", err)
+	}
+
+	triggerChan := make(chan struct{}, 1)
+
 	http.Handle("/metrics", prometheus.Handler())
+	http.Handle("/reload", requireClientCert(webClientCAFile != "", reloadHandler(triggerChan)))
 	go func() {
-		err := http.ListenAndServe(metricsAddr, nil)
+		srv := &http.Server{Addr: metricsAddr, TLSConfig: tlsConfig}
+		var err error
+		if webTLSCertFile != "" {
+			err = srv.ListenAndServeTLS(webTLSCertFile, webTLSKeyFile)
+		} else {
+			err = srv.ListenAndServe()
+		}
 		if err != nil {
 			log.Fatalf("Could not start metrics server: %v", err)
 			os.Exit(1)
 		}
 	}()
 
-	log.V(2).Infof("Checking config every %v or on changes to %v", pollInterval, configInputFile)
-	updateChan, err := watchAndTick(ctx, configInputFile, pollInterval)
+	if !isFileSource(configInputFile) {
+		log.V(2).Infof("Input config %v is not a file, changes will only be picked up every %v", configInputFile, pollInterval)
+	} else if waitForInput {
+		err = waitForFile(ctx, configInputFile, inputWaitInterval)
+		if err != nil {
+			log.Fatalf("Failed waiting for input config file: %v", err)
+		}
+	} else if _, err := os.Stat(configInputFile); os.IsNotExist(err) {
+		log.Fatalf("Input config file %v does not exist, create it or pass -wait-for-input to wait for it", configInputFile)
+	}
+
+	if hubBearerTokenRefresh {
+		_, err := newGCPTokenSource(ctx)
+		if err != nil {
+			log.Fatalf("Could not refresh bearer token: %v", err)
+		}
+		go refreshTokenFile(ctx, newGCPTokenSource, hubBearerTokenFile, hubBearerTokenMargin)
+	}
+
+	watched := []string{configInputFile}
+	watched = append(watched, rolesFiles...)
+	log.V(2).Infof("Checking config every %v or on changes to %v", pollInterval, strings.Join(watched, ", "))
+	updateChan, err := watchAndTick(ctx, watched, pollInterval, pollJitter, triggerChan, !skipInitialSync, startupDelay)
 	if err != nil {
-		log.Fatalf("Failed to watch input file: %v", err)
+		log.Fatalf("Failed to watch input files: %v", err)
 	}
 
+	// Clusters whose certs can't be written are discovered but left out of the config, so polls
+	// are compared with what was discovered, not what was written
+	discoveredClusters := []*container.Cluster{}
 	currentClusters := []*container.Cluster{}
+	currentMemberships := []hubMembership{}
+	lastReload := time.Time{}
+	generation := uint64(0)
+	syncStatuses := map[string]clusterSyncStatus{}
 
 	loop := func(force bool) error {
 		started := time.Now()
-		defer syncDuration.Observe(float64(time.Now().Sub(started)) / float64(time.Second))
+		defer func() {
+			syncDuration.Observe(time.Since(started).Seconds())
+		}()
 
-		ctx, cancel := context.WithTimeout(ctx, pollInterval)
+		syncCtx, cancel := context.WithTimeout(ctx, pollInterval)
 		defer cancel()
 
-		newClusters, err := findClusters(ctx, gcpProject)
+		phaseStarted := time.Now()
+		lister, err := newGCPClusterLister(syncCtx)
+		if err != nil {
+			return inPhase(phaseDiscovery, errors.Wrap(err, "could not create cluster lister"))
+		}
+		// Roles are read again each sync to pick up edits, keeping the previous roles if they're
+		// now invalid
+		if len(rolesFiles) > 0 {
+			newRoles, err := loadRoles(rolesFiles, rolesMerge)
+			if err != nil {
+				log.Errorf("Could not reload roles, keeping the previous roles: %v", err)
+			} else {
+				roles = newRoles
+			}
+		}
+
+		projects := append([]string{gcpProject}, serviceProjects...)
+		newClusters, err := findProjectsClusters(syncCtx, lister, projects, flagBackoff(backoffMax))
+		phaseDuration.WithLabelValues(phaseDiscovery).Observe(time.Since(phaseStarted).Seconds())
 		if err != nil {
-			return errors.Wrap(err, "could not find clusters")
+			return inPhase(phaseDiscovery, errors.Wrap(err, "could not find clusters"))
+		}
+
+		newClusters = holdUnstableClusters(currentClusters, newClusters)
+
+		newMemberships := []hubMembership{}
+		if discoverHubMemberships {
+			hubLister, err := newGCPMembershipLister(syncCtx)
+			if err != nil {
+				return inPhase(phaseDiscovery, errors.Wrap(err, "could not create membership lister"))
+			}
+			newMemberships, err = findMemberships(syncCtx, hubLister, gcpProject)
+			if err != nil {
+				return inPhase(phaseDiscovery, errors.Wrap(err, "could not find hub memberships"))
+			}
+		}
+
+		if maxClusters > 0 && len(newClusters) > maxClusters {
+			discoveryOverLimit.Inc()
+			return inPhase(phaseDiscovery, errors.Errorf("discovered %v clusters, more than the limit of %v", len(newClusters), maxClusters))
+		}
+
+		if len(newClusters) == 0 && len(discoveredClusters) > 0 {
+			log.Warningf("Discovered no clusters, previously found %v", len(discoveredClusters))
+			emptyDiscoveries.Inc()
+			if refuseEmpty {
+				return inPhase(phaseDiscovery, errors.New("refusing to remove all clusters from config"))
+			}
 		}
 
 		if !force {
-			changes := !clusterListEqual(currentClusters, newClusters)
+			changes := !clusterListEqual(discoveredClusters, newClusters) || !membershipListEqual(currentMemberships, newMemberships)
 			if !changes {
-				return nil
+				// Clusters left out for failing to write their certs are retried, but only
+				// sync once at least one of them can be written
+				unwritten := unwrittenClusters(currentClusters, newClusters)
+				if len(unwritten) == 0 || !certsWritable(certOutDir, unwritten, certWriteConcurrency) {
+					return nil
+				}
+				log.V(2).Infof("Certs can now be written for previously failed clusters")
+			} else {
+				log.V(2).Infof("Change in clusters composition")
 			}
-			log.V(2).Infof("Change in clusters composition")
 		} else {
 			log.V(2).Infof("Forcing reload")
 		}
@@ -167,183 +786,995 @@ func main() {
 		}
 		clusterCount.Set(float64(len(newClusters)))
 
-		err = writeClusterCerts(certOutDir, newClusters)
+		// Certs and config are staged, and only put in place together once all are written, and
+		// the config checked if promtool is configured. Without promtool, an invalid config is
+		// only found by the reload, and the previous files are put back when it fails.
+		txn := newWriteTxn()
+		defer txn.Cleanup()
+		stagedCertDir, err := txn.Dir(certOutDir)
 		if err != nil {
-			return errors.Wrap(err, "could not update cluster certs")
+			return inPhase(phaseCerts, errors.Wrap(err, "could not stage certs"))
 		}
-		log.V(2).Infof("Wrote certs to %v", certOutDir)
 
-		newConfig, err := generateConfig(configInputFile, certReferenceDir, newClusters)
+		// Clusters whose certs could not be written are left out of this sync, and will be
+		// retried on the next poll as they will be missing from currentClusters
+		phaseStarted = time.Now()
+		discovered := newClusters
+		newClusters, err = writeClusterCerts(stagedCertDir, newClusters, certWriteConcurrency, failOnPartial)
 		if err != nil {
-			return errors.Wrap(err, "could not generate config")
+			return inPhase(phaseCerts, errors.Wrap(err, "could not update cluster certs"))
 		}
-		err = ioutil.WriteFile(configOutputFile, newConfig, 0600)
-		if err != nil {
-			return errors.Wrap(err, "could not write config")
+		if caBundle {
+			err = writeCABundle(stagedCertDir, newClusters)
+			if err != nil {
+				return inPhase(phaseCerts, errors.Wrap(err, "could not write ca bundle"))
+			}
+		}
+		log.V(2).Infof("Staged certs for %v", certOutDir)
+
+		if writeKubeconfig || sdKubeconfig {
+			err = writeKubeconfigs(stagedCertDir, flagConfigOptions(certReferenceDir), newClusters)
+			if err != nil {
+				return inPhase(phaseCerts, errors.Wrap(err, "could not write kubeconfigs"))
+			}
+			log.V(2).Infof("Staged kubeconfigs for %v", certOutDir)
+		}
+		phaseDuration.WithLabelValues(phaseCerts).Observe(time.Since(phaseStarted).Seconds())
+		if log.V(2) {
+			for _, c := range newClusters {
+				log.Infof("Prometheus will read %v certs from %v", c.Name, filepath.Dir(flagConfigOptions(certReferenceDir).certReference(c, "ca")))
+			}
 		}
-		log.V(2).Infof("Wrote config to %v", configOutputFile)
 
-		err = reloadPrometheus(ctx, prometheusAddress)
+		opts := flagConfigOptions(certReferenceDir)
+		if stampGeneration {
+			opts.Generation = nextGeneration(generation, started)
+			log.V(2).Infof("Stamping targets with generation %v", opts.Generation)
+		}
+
+		phaseStarted = time.Now()
+		if outputFormat == "operator" {
+			stagedManifestDir, err := txn.Dir(operatorOutputDir)
+			if err != nil {
+				return inPhase(phaseConfig, errors.Wrap(err, "could not stage manifests"))
+			}
+			err = writeOperatorManifests(stagedManifestDir, operatorNamespace, opts, roles, newClusters)
+			if err != nil {
+				return inPhase(phaseConfig, errors.Wrap(err, "could not write manifests"))
+			}
+		} else {
+			newConfig, err := generateConfig(syncCtx, configInputFile, opts, roles, newClusters, newMemberships)
+			if err != nil {
+				return inPhase(phaseConfig, errors.Wrap(err, "could not generate config"))
+			}
+			stagedConfigDir, err := txn.Dir(filepath.Dir(configOutputFile))
+			if err != nil {
+				return inPhase(phaseConfig, errors.Wrap(err, "could not stage config"))
+			}
+			stagedConfigFile := filepath.Join(stagedConfigDir, filepath.Base(configOutputFile))
+			err = writeConfig(stagedConfigFile, newConfig)
+			if err != nil {
+				return inPhase(phaseConfig, errors.Wrap(err, "could not write config"))
+			}
+			if promtoolPath != "" {
+				err = checkConfig(syncCtx, promtoolPath, stagedConfigFile)
+				if err != nil {
+					return inPhase(phaseConfig, errors.Wrap(err, "invalid config"))
+				}
+			}
+		}
+		err = txn.Promote()
+		if err != nil {
+			return inPhase(phaseConfig, errors.Wrap(err, "could not put certs and config in place"))
+		}
+		if outputFormat == "operator" {
+			// Departed clusters' manifests can't be staged, so are removed once the rest are in place
+			err = pruneOperatorManifests(operatorOutputDir, newClusters)
+			if err != nil {
+				log.Errorf("Could not remove stale manifests: %v", err)
+			}
+			log.V(2).Infof("Wrote certs to %v and manifests to %v", certOutDir, operatorOutputDir)
+		} else {
+			log.V(2).Infof("Wrote certs to %v and config to %v", certOutDir, configOutputFile)
+		}
+		phaseDuration.WithLabelValues(phaseConfig).Observe(time.Since(phaseStarted).Seconds())
+
+		// Reloading gets its own timeout so a slow discovery can't starve it
+		reloadCtx, reloadCancel := context.WithTimeout(ctx, reloadTimeout)
+		defer reloadCancel()
+		phaseStarted = time.Now()
+		err = reloader.Reload(reloadCtx)
+		phaseDuration.WithLabelValues(phaseReload).Observe(time.Since(phaseStarted).Seconds())
 		if err != nil {
-			return errors.Wrap(err, "could not reload prometheus")
+			rerr := txn.Rollback()
+			if rerr != nil {
+				log.Errorf("Could not restore previous certs and config: %v", rerr)
+			}
+			return inPhase(phaseReload, errors.Wrap(err, "could not reload prometheus"))
 		}
 
 		// Only set new clusters after a successful reload
+		discoveredClusters = discovered
 		currentClusters = newClusters
+		currentMemberships = newMemberships
+		lastReload = time.Now()
+		generation = opts.Generation
+
+		if textfileOutput != "" {
+			syncStatuses = updateSyncStatuses(syncStatuses, discovered, newClusters, opts, roles, lastReload)
+			err = writeTextfile(textfileOutput, syncStatuses)
+			if err != nil {
+				log.Errorf("Could not write textfile: %v", err)
+			}
+		}
+		if inventoryOutput != "" {
+			err = writeInventory(inventoryOutput, clusterInventory(newClusters, gcpProject))
+			if err != nil {
+				log.Errorf("Could not write inventory: %v", err)
+			}
+		}
 		return nil
 	}
 
 	for force := range updateChan {
+		if wait := minReloadInterval - time.Since(lastReload); wait > 0 {
+			log.V(2).Infof("Waiting %v since the last reload before syncing", wait)
+			force = coalesceUpdates(updateChan, force, wait)
+		}
 		err := loop(force)
 		if err != nil {
 			log.Errorf("Config check/update loop failed: %v", err)
-			syncResult.WithLabelValues("failure").Inc()
+			syncResult.WithLabelValues("failure", syncPhase(err)).Inc()
 		} else {
-			syncResult.WithLabelValues("success").Inc()
+			syncResult.WithLabelValues("success", phaseNone).Inc()
 		}
 	}
 }
 
-func reloadPrometheus(ctx context.Context, prometheusLocation string) error {
-	url := fmt.Sprintf("%v/-/reload", prometheusLocation)
-	backoff := reloadInterval
-	for i := 0; ctx.Err() == nil; i++ {
-		log.V(2).Infof("Reloading prometheus")
-		_, err := ctxhttp.Post(ctx, http.DefaultClient, url, "", nil)
-		if err == nil {
-			log.Infof("Reloaded prometheus")
-			return nil
-		}
-		log.Errorf("Failed to reload prometheus: %v", err)
+// nextGeneration returns the generation to stamp a sync started at now with, its unix time, or
+// one more than the last generation if that's not before it, so each sync's is unique
+func nextGeneration(last uint64, now time.Time) uint64 {
+	gen := uint64(now.Unix())
+	if gen <= last {
+		gen = last + 1
+	}
+	return gen
+}
 
-		log.V(2).Infof("Backing off for %v", backoff)
+// coalesceUpdates waits for d, folding any updates received meanwhile into force
+func coalesceUpdates(updates <-chan bool, force bool, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	for {
 		select {
-		case <-time.After(backoff):
-		case <-ctx.Done():
+		case f, ok := <-updates:
+			if !ok {
+				return force
+			}
+			force = force || f
+		case <-t.C:
+			return force
 		}
-		backoff = time.Duration(float64(backoff) * reloadBackoff)
 	}
-	return ctx.Err()
 }
 
-func writeClusterCerts(outDir string, clusters []*container.Cluster) error {
-	for _, cluster := range clusters {
-		err := writeCert(outDir, cluster.Name, "ca", cluster.MasterAuth.ClusterCaCertificate)
-		if err != nil {
-			return errors.Wrap(err, "could not write ca cert")
-		}
-		err = writeCert(outDir, cluster.Name, "cert", cluster.MasterAuth.ClientCertificate)
-		if err != nil {
-			return errors.Wrap(err, "could not write client cert")
-		}
-		err = writeCert(outDir, cluster.Name, "key", cluster.MasterAuth.ClientKey)
-		if err != nil {
-			return errors.Wrap(err, "could not write client key")
+// reloadHandler queues a forced sync and returns immediately. Triggers received while one is
+// already pending are coalesced.
+func reloadHandler(trigger chan<- struct{}) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
 		}
-	}
-	return nil
-}
 
-func writeCert(outDir, clusterName, certType, b64Cert string) error {
-	cert, err := base64.StdEncoding.DecodeString(b64Cert)
-	if err != nil {
-		return errors.Wrap(err, "could not b64 decode cert")
-	}
-	fname := fmt.Sprintf("%v/%v-%v.pem", outDir, clusterName, certType)
-	err = ioutil.WriteFile(fname, cert, 0600)
-	return errors.Wrap(err, "could not write file")
+		select {
+		case trigger <- struct{}{}:
+			log.V(2).Infof("Manual sync requested")
+		default:
+			log.V(2).Infof("Manual sync already pending")
+		}
+		w.WriteHeader(http.StatusAccepted)
+	})
 }
 
-func generateConfig(inputConfigFilename, certDir string, clusters []*container.Cluster) ([]byte, error) {
-	inputConfig, err := readInputConfig(inputConfigFilename)
+// runCheck validates the roles file and input config by generating a config for a fake cluster,
+// without contacting GCP or writing anything
+func runCheck(ctx context.Context, inputConfigFilename string, rolesFiles []string, certDir string) error {
+	roles, err := loadRoles(rolesFiles, rolesMerge)
 	if err != nil {
-		return []byte{}, errors.Wrapf(err, "could not load input config at %v", inputConfigFilename)
+		return errors.Wrap(err, "could not load roles")
 	}
 
-	scrapeConfigs := []ScrapeConfig{}
-	for _, c := range clusters {
-		scrapeConfigs = append(scrapeConfigs, clusterToScrapeConfigs(certDir, c)...)
-	}
-
-	inputConfig.ScrapeConfigs = append(inputConfig.ScrapeConfigs, scrapeConfigs...)
-
-	data, err := yaml.Marshal(inputConfig)
-	return data, errors.Wrap(err, "could not marshal config")
-}
-
-func clusterToScrapeConfigs(certDir string, cluster *container.Cluster) []ScrapeConfig {
-	configs := []ScrapeConfig{}
-	for r, c := range GetRoles() {
-		configs = append(configs, ScrapeConfig{
-			JobName: fmt.Sprintf("kubernetes_%v_%v", cluster.Name, r),
-			BasicAuth: BasicAuth{
-				Username: cluster.MasterAuth.Username,
-				Password: cluster.MasterAuth.Password,
-			},
-			KubernetesSDConfigs: []KubeSDConfig{
-				{
-					APIServers: []string{
-						"https://" + cluster.Endpoint,
-					},
-					Role:          r,
-					InCluster:     false,
-					RetryInterval: retryInterval.String(),
-					TLSConfig: TLSConfig{
-						CAFile:   fmt.Sprintf("%v/%v-ca.pem", certDir, cluster.Name),
-						CertFile: fmt.Sprintf("%v/%v-cert.pem", certDir, cluster.Name),
-						KeyFile:  fmt.Sprintf("%v/%v-key.pem", certDir, cluster.Name),
-					},
-				},
-			},
-			RelabelConfigs: c,
-		})
+	cluster := &container.Cluster{
+		Name:     "check",
+		Endpoint: "127.0.0.1",
+		MasterAuth: &container.MasterAuth{
+			ClusterCaCertificate: "Y2hlY2s=",
+			ClientCertificate:    "Y2hlY2s=",
+			ClientKey:            "Y2hlY2s=",
+		},
 	}
-	return configs
-}
-
-func readInputConfig(inputConfigFilename string) (PrometheusConfig, error) {
-	data, err := ioutil.ReadFile(inputConfigFilename)
+	data, err := generateConfig(ctx, inputConfigFilename, flagConfigOptions(certDir), roles, []*container.Cluster{cluster}, nil)
 	if err != nil {
-		return PrometheusConfig{}, errors.Wrap(err, "could not read input config")
+		return errors.Wrap(err, "could not generate config")
 	}
 
+	// Make sure what we would write can be read back
 	config := PrometheusConfig{}
 	err = yaml.Unmarshal(data, &config)
-	return config, errors.Wrap(err, "could not parse input config")
+	return errors.Wrap(err, "generated config is not valid")
 }
 
-// Returns a channel that will is a union of time.Tick and watchFile. Messages will be `true` if
-// triggered by watchFile, otherwise `false`
-func watchAndTick(ctx context.Context, fname string, interval time.Duration) (<-chan bool, error) {
-	ch := make(chan bool)
+// runDiff discovers clusters and prints a diff from the current output config to the config
+// that would be written, without writing anything. A missing output config diffs as empty.
+func runDiff(ctx context.Context, roles map[string]Role) error {
+	ctx, cancel := context.WithTimeout(ctx, pollInterval)
+	defer cancel()
 
-	wch, err := watchFile(ctx, fname)
+	lister, err := newGCPClusterLister(ctx)
+	if err != nil {
+		return errors.Wrap(err, "could not create cluster lister")
+	}
+	projects := append([]string{gcpProject}, serviceProjects...)
+	clusters, err := findProjectsClusters(ctx, lister, projects, flagBackoff(backoffMax))
 	if err != nil {
-		return ch, err
+		return errors.Wrap(err, "could not find clusters")
 	}
-	tch := time.Tick(interval)
 
-	go func() {
-		ch <- false // Add an initial tick
-		for {
-			select {
-			case <-wch:
-				ch <- true
-			case <-tch:
-				ch <- false
-			}
+	memberships := []hubMembership{}
+	if discoverHubMemberships {
+		hubLister, err := newGCPMembershipLister(ctx)
+		if err != nil {
+			return errors.Wrap(err, "could not create membership lister")
 		}
-	}()
-
-	return ch, nil
-}
-
-func watchFile(ctx context.Context, fname string) (<-chan struct{}, error) {
-	ch := make(chan struct{})
+		memberships, err = findMemberships(ctx, hubLister, gcpProject)
+		if err != nil {
+			return errors.Wrap(err, "could not find hub memberships")
+		}
+	}
 
-	watcher, err := fsnotify.NewWatcher()
+	newConfig, err := generateConfig(ctx, configInputFile, flagConfigOptions(certReferenceDir), roles, clusters, memberships)
 	if err != nil {
-		return ch, errors.Wrap(err, "could not create fsnotify watcher")
+		return errors.Wrap(err, "could not generate config")
+	}
+	oldConfig, err := ioutil.ReadFile(configOutputFile)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "could not read current config")
+	}
+
+	fmt.Print(unifiedDiff(configOutputFile, configOutputFile+" (generated)", oldConfig, newConfig))
+	return nil
+}
+
+// reloadAllPrometheus reloads each Prometheus server concurrently, so a failing server doesn't
+// hold up the others. Unless requireAll is set, the reload only fails if every server failed.
+func reloadAllPrometheus(ctx context.Context, prometheusLocations []string, requireAll bool) error {
+	errs := make([]error, len(prometheusLocations))
+	wg := sync.WaitGroup{}
+	for i, location := range prometheusLocations {
+		wg.Add(1)
+		go func(i int, location string) {
+			defer wg.Done()
+			errs[i] = reloadPrometheus(ctx, location)
+			if errs[i] != nil {
+				reloadResult.WithLabelValues(location, "failure").Inc()
+			} else {
+				reloadResult.WithLabelValues(location, "success").Inc()
+			}
+		}(i, location)
+	}
+	wg.Wait()
+
+	failures := []string{}
+	for i, err := range errs {
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%v: %v", prometheusLocations[i], err))
+		}
+	}
+	if len(failures) == 0 {
+		return nil
+	}
+	if !requireAll && len(failures) < len(prometheusLocations) {
+		log.Warningf("Some prometheus servers failed to reload: %v", strings.Join(failures, "; "))
+		return nil
+	}
+	return errors.Errorf("failed to reload %v", strings.Join(failures, "; "))
+}
+
+func reloadPrometheus(ctx context.Context, prometheusLocation string) (err error) {
+	started := time.Now()
+	defer func() {
+		outcome := "success"
+		if err != nil {
+			outcome = "failure"
+		}
+		reloadDuration.WithLabelValues(outcome).Observe(time.Since(started).Seconds())
+	}()
+
+	url := fmt.Sprintf("%v/-/reload", prometheusLocation)
+	req, err := http.NewRequestWithContext(ctx, reloadMethod, url, nil)
+	if err != nil {
+		return errors.Wrap(err, "could not create reload request")
+	}
+	b := flagBackoff(reloadMaxBackoff)
+	for {
+		log.V(2).Infof("Reloading prometheus at %v", prometheusLocation)
+		res, err := http.DefaultClient.Do(req)
+		if err == nil {
+			// Prometheus answered, so an error won't go away by retrying
+			body, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+			res.Body.Close()
+			if res.StatusCode/100 != 2 {
+				return errors.Errorf("reload of prometheus at %v failed with %v: %v", prometheusLocation, res.Status, strings.TrimSpace(string(body)))
+			}
+			log.Infof("Reloaded prometheus at %v", prometheusLocation)
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		log.Errorf("Failed to reload prometheus at %v: %v", prometheusLocation, err)
+
+		err = b.Wait(ctx)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// writeConfig writes the output config, creating its directory if needed
+func writeConfig(fname string, data []byte) error {
+	err := os.MkdirAll(filepath.Dir(fname), os.FileMode(dirMode))
+	if err != nil {
+		return errors.Wrap(err, "could not create config directory")
+	}
+	err = writeFileRetrying(fname, data, os.FileMode(configFileMode))
+	if err != nil {
+		return err
+	}
+	configWrites.Inc()
+	return nil
+}
+
+// unwrittenClusters returns the clusters of discovered that aren't in written
+func unwrittenClusters(written, discovered []*container.Cluster) []*container.Cluster {
+	keys := map[string]bool{}
+	for _, c := range written {
+		keys[clusterKey(c)] = true
+	}
+	unwritten := []*container.Cluster{}
+	for _, c := range discovered {
+		if !keys[clusterKey(c)] {
+			unwritten = append(unwritten, c)
+		}
+	}
+	return unwritten
+}
+
+// certsWritable returns whether the certs of any of clusters can be written to outDir. They're
+// staged and then discarded, leaving outDir as it was.
+func certsWritable(outDir string, clusters []*container.Cluster, workers int) bool {
+	txn := newWriteTxn()
+	defer txn.Cleanup()
+	stage, err := txn.Dir(outDir)
+	if err != nil {
+		log.Errorf("Could not stage certs: %v", err)
+		return false
+	}
+	_, err = writeClusterCerts(stage, clusters, workers, false)
+	return err == nil
+}
+
+// writeClusterCerts writes the certs of each cluster using up to workers goroutines, returning
+// the clusters that were written successfully in their original order. A failure for one cluster
+// is logged and counted, but doesn't stop the others. An error is returned if no cluster could be
+// written, or with requireAll if any couldn't.
+func writeClusterCerts(outDir string, clusters []*container.Cluster, workers int, requireAll bool) ([]*container.Cluster, error) {
+	err := os.MkdirAll(outDir, os.FileMode(dirMode))
+	if err != nil {
+		return []*container.Cluster{}, errors.Wrap(err, "could not create cert directory")
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	errs := make([]error, len(clusters))
+	sem := make(chan struct{}, workers)
+	wg := sync.WaitGroup{}
+	for i, cluster := range clusters {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, cluster *container.Cluster) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			// Cert writes also share the limit on operations across discovery and writing
+			opsLimit.Acquire(context.Background())
+			defer opsLimit.Release()
+			errs[i] = writeClusterCert(outDir, cluster)
+		}(i, cluster)
+	}
+	wg.Wait()
+
+	written := []*container.Cluster{}
+	for i, cluster := range clusters {
+		if errs[i] != nil {
+			log.Errorf("Could not write certs for cluster %v: %v", cluster.Name, errs[i])
+			clusterCertErrors.WithLabelValues(cluster.Name).Inc()
+			continue
+		}
+		written = append(written, cluster)
+	}
+	if len(clusters) > 0 && len(written) == 0 {
+		return written, errors.Errorf("could not write certs for any of %v clusters", len(clusters))
+	}
+	if requireAll && len(written) < len(clusters) {
+		return written, errors.Errorf("could not write certs for %v of %v clusters", len(clusters)-len(written), len(clusters))
+	}
+	return written, nil
+}
+
+func writeClusterCert(outDir string, cluster *container.Cluster) error {
+	if cluster.MasterAuth == nil {
+		return errors.New("cluster has no master auth")
+	}
+	if basicAuthUsePasswordFile && cluster.MasterAuth.Password != "" {
+		err := writeFileRetrying(passwordPath(outDir, cluster.Name), []byte(cluster.MasterAuth.Password), os.FileMode(certFileMode))
+		if err != nil {
+			return errors.Wrap(err, "could not write basic auth password")
+		}
+	}
+	// With a CA bundle the ca cert is only written as part of the bundle, but is checked here so
+	// a cluster with a bad ca cert is left out rather than failing the bundle
+	if caBundle {
+		_, err := base64.StdEncoding.DecodeString(cluster.MasterAuth.ClusterCaCertificate)
+		if err != nil {
+			return errors.Wrap(err, "could not b64 decode ca cert")
+		}
+	} else {
+		err := writeCert(outDir, cluster, "ca", cluster.MasterAuth.ClusterCaCertificate)
+		if err != nil {
+			return errors.Wrap(err, "could not write ca cert")
+		}
+	}
+	if !hasClientCert(cluster) {
+		log.V(2).Infof("Cluster %v has no client certificate, only writing ca cert", cluster.Name)
+		return nil
+	}
+	err := writeCert(outDir, cluster, "cert", cluster.MasterAuth.ClientCertificate)
+	if err != nil {
+		return errors.Wrap(err, "could not write client cert")
+	}
+	err = writeCert(outDir, cluster, "key", cluster.MasterAuth.ClientKey)
+	if err != nil {
+		return errors.Wrap(err, "could not write client key")
+	}
+	return nil
+}
+
+func writeCert(outDir string, cluster *container.Cluster, certType, b64Cert string) error {
+	clusterName := cluster.Name
+	cert, err := base64.StdEncoding.DecodeString(b64Cert)
+	if err != nil {
+		return errors.Wrapf(err, "could not b64 decode %v cert for cluster %v", certType, clusterName)
+	}
+	fname := clusterCertPath(outDir, certFilenameTmpl, cluster, certType)
+	err = writeFileRetrying(fname, cert, os.FileMode(certFileMode))
+	if err != nil {
+		return errors.Wrap(err, "could not write file")
+	}
+	certWrites.WithLabelValues(certType).Inc()
+
+	if certType != "key" {
+		notAfter, err := certNotAfter(cert)
+		if err != nil {
+			log.V(2).Infof("Could not check expiry of %v cert for cluster %v: %v", certType, clusterName, err)
+			return nil
+		}
+		certExpiry.WithLabelValues(clusterName, certType).Set(float64(notAfter.Unix()))
+		if time.Until(notAfter) < certExpiryWarning {
+			log.Warningf("The %v cert for cluster %v expires at %v", certType, clusterName, notAfter)
+		}
+	}
+	return nil
+}
+
+// certNotAfter returns the expiry of the first certificate in PEM encoded data
+func certNotAfter(data []byte) (time.Time, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return time.Time{}, errors.New("no PEM data found")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return time.Time{}, errors.Wrap(err, "could not parse certificate")
+	}
+	return cert.NotAfter, nil
+}
+
+// writeCABundle writes the ca certs of all clusters to a single bundle in outDir
+func writeCABundle(outDir string, clusters []*container.Cluster) error {
+	bundle := []byte{}
+	for _, c := range clusters {
+		if c.MasterAuth == nil {
+			return errors.Errorf("cluster %v has no master auth", c.Name)
+		}
+		cert, err := base64.StdEncoding.DecodeString(c.MasterAuth.ClusterCaCertificate)
+		if err != nil {
+			return errors.Wrapf(err, "could not b64 decode ca cert for cluster %v", c.Name)
+		}
+		bundle = append(bundle, cert...)
+		if len(cert) > 0 && cert[len(cert)-1] != '\n' {
+			bundle = append(bundle, '\n')
+		}
+	}
+	err := writeFileRetrying(caBundlePath(outDir), bundle, os.FileMode(certFileMode))
+	return errors.Wrap(err, "could not write file")
+}
+
+// caBundleCertType is the cert type that cert reference templates are given for the ca bundle
+const caBundleCertType = "ca-bundle"
+
+// caBundlePath returns the location of the ca bundle within dir
+func caBundlePath(dir string) string {
+	return fmt.Sprintf("%v/ca-bundle.pem", dir)
+}
+
+// passwordPath returns the location of a cluster's basic auth password file within dir
+func passwordPath(dir, clusterName string) string {
+	return fmt.Sprintf("%v/%v-password", dir, clusterName)
+}
+
+// hasClientCert reports whether the cluster has client certificate material, which is absent
+// for clusters with client certificate auth disabled
+func hasClientCert(cluster *container.Cluster) bool {
+	return cluster.MasterAuth != nil &&
+		cluster.MasterAuth.ClientCertificate != "" &&
+		cluster.MasterAuth.ClientKey != ""
+}
+
+// certPath returns the location of a cluster's certificate of the given type within dir
+func certPath(dir, clusterName, certType string) string {
+	return fmt.Sprintf("%v/%v-%v.pem", dir, clusterName, certType)
+}
+
+// certFilenameData is what a cert filename template is executed with
+type certFilenameData struct {
+	ClusterName string
+	Project     string
+	Location    string
+	Type        string
+}
+
+// newCertFilenameData returns the template data for cluster's cert of certType
+func newCertFilenameData(cluster *container.Cluster, certType string) certFilenameData {
+	project := selfLinkProject(cluster.SelfLink)
+	if project == "" {
+		project = gcpProject
+	}
+	return certFilenameData{
+		ClusterName: cluster.Name,
+		Project:     project,
+		Location:    clusterLocation(cluster),
+		Type:        certType,
+	}
+}
+
+// unsafeFilenameChars matches the characters replaced in templated cert filenames
+var unsafeFilenameChars = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// clusterCertPath returns the location of a cluster's certificate of the given type within dir,
+// named by tmpl if given, or as certPath otherwise. Templated names have characters that aren't
+// safe in filenames replaced with _.
+func clusterCertPath(dir string, tmpl *template.Template, cluster *container.Cluster, certType string) string {
+	if tmpl == nil {
+		return certPath(dir, cluster.Name, certType)
+	}
+
+	buf := &bytes.Buffer{}
+	err := tmpl.Execute(buf, newCertFilenameData(cluster, certType))
+	if err != nil {
+		// Templates are checked when parsed, so this should never happen
+		log.Errorf("Could not template %v cert filename for cluster %v: %v", certType, cluster.Name, err)
+		return certPath(dir, cluster.Name, certType)
+	}
+	return filepath.Join(dir, unsafeFilenameChars.ReplaceAllString(buf.String(), "_"))
+}
+
+// parseCertFilenameTemplate parses a cert filename template, checking it can be executed and
+// gives each of a cluster's ca, cert and key a different name, so they don't overwrite each other
+func parseCertFilenameTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("cert-filename").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not parse template")
+	}
+	types := map[string]string{}
+	for _, certType := range []string{"ca", "cert", "key"} {
+		buf := &bytes.Buffer{}
+		err = tmpl.Execute(buf, certFilenameData{ClusterName: "cluster", Project: "project", Location: "location", Type: certType})
+		if err != nil {
+			return nil, errors.Wrap(err, "could not execute template")
+		}
+		if other, ok := types[buf.String()]; ok {
+			return nil, errors.Errorf("template gives the %v and %v certs the same name %v, use {{ .Type }}", other, certType, buf.String())
+		}
+		types[buf.String()] = certType
+	}
+	return tmpl, nil
+}
+
+// validateCertDirs checks that certificates written to outDir will be visible to Prometheus at
+// referenceDir. Differing paths are only accepted if one of them lives on a mounted volume, in
+// which case we assume the volume is shared with Prometheus under another path.
+func validateCertDirs(outDir, referenceDir string, mountPoints []string) error {
+	if filepath.Clean(outDir) == filepath.Clean(referenceDir) {
+		return nil
+	}
+	if isMountedPath(outDir, mountPoints) || isMountedPath(referenceDir, mountPoints) {
+		log.V(2).Infof("Certificate output path %v differs from reference path %v, assuming a shared volume", outDir, referenceDir)
+		return nil
+	}
+	return errors.Errorf("certificates are written to %v but prometheus is configured to read them from %v, and neither is a mounted volume", outDir, referenceDir)
+}
+
+// isMountedPath reports whether path is at or below one of mountPoints, ignoring the root mount
+func isMountedPath(path string, mountPoints []string) bool {
+	path = filepath.Clean(path)
+	for _, mp := range mountPoints {
+		mp = filepath.Clean(mp)
+		if mp == "/" {
+			continue
+		}
+		if path == mp || strings.HasPrefix(path, mp+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// readMountPoints returns the mount points listed in /proc/mounts, or nothing if they can't be read
+func readMountPoints() []string {
+	data, err := ioutil.ReadFile("/proc/mounts")
+	if err != nil {
+		log.V(2).Infof("Could not read mount points: %v", err)
+		return []string{}
+	}
+
+	mountPoints := []string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		mountPoints = append(mountPoints, fields[1])
+	}
+	return mountPoints
+}
+
+// generateConfig reads the input config and returns it marshaled with the jobs for clusters and
+// hub memberships added
+func generateConfig(ctx context.Context, inputConfigFilename string, opts configOptions, roles map[string]Role, clusters []*container.Cluster, memberships []hubMembership) ([]byte, error) {
+	inputConfig, err := readInputConfig(ctx, inputConfigFilename)
+	if err != nil {
+		return []byte{}, errors.Wrapf(err, "could not load input config at %v", inputConfigFilename)
+	}
+	if stripGeneratedJobs {
+		inputConfig.ScrapeConfigs = withoutGeneratedJobs(inputConfig.ScrapeConfigs)
+	}
+
+	config, err := buildConfig(inputConfig, opts, roles, clusters)
+	if err != nil {
+		return []byte{}, err
+	}
+	if len(memberships) > 0 {
+		config.ScrapeConfigs = appendUniqueJobs(config.ScrapeConfigs, membershipsToScrapeConfigs(opts, roles, memberships, hubBearerTokenFile))
+	}
+	scrapeConfigsGenerated.Set(float64(len(config.ScrapeConfigs) - len(inputConfig.ScrapeConfigs)))
+
+	if extraScrapeConfigsDir != "" {
+		extra, err := readExtraScrapeConfigs(extraScrapeConfigsDir)
+		if err != nil {
+			return []byte{}, errors.Wrapf(err, "could not load extra scrape configs from %v", extraScrapeConfigsDir)
+		}
+		config.ScrapeConfigs = appendUniqueJobs(config.ScrapeConfigs, extra)
+	}
+	scrapeConfigsTotal.Set(float64(len(config.ScrapeConfigs)))
+
+	data, err := yaml.Marshal(config)
+	if err != nil {
+		return []byte{}, errors.Wrap(err, "could not marshal config")
+	}
+	configBytes.Set(float64(len(data)))
+	if configSizeWarn > 0 && len(data) > configSizeWarn {
+		log.Warningf("Generated config is %v bytes, more than %v, which may slow Prometheus reloads", len(data), configSizeWarn)
+	}
+	return data, nil
+}
+
+// readExtraScrapeConfigs reads the lists of scrape configs in each *.yml file in dir, in file
+// name order
+func readExtraScrapeConfigs(dir string) ([]ScrapeConfig, error) {
+	fnames, err := filepath.Glob(filepath.Join(dir, "*.yml"))
+	if err != nil {
+		return []ScrapeConfig{}, errors.Wrap(err, "could not list files")
+	}
+
+	scrapeConfigs := []ScrapeConfig{}
+	for _, fname := range fnames {
+		data, err := ioutil.ReadFile(fname)
+		if err != nil {
+			return []ScrapeConfig{}, errors.Wrapf(err, "could not read %v", fname)
+		}
+		scs := []ScrapeConfig{}
+		err = yaml.Unmarshal(data, &scs)
+		if err != nil {
+			return []ScrapeConfig{}, errors.Wrapf(describeYAMLError(data, err), "could not parse %v", fname)
+		}
+		scrapeConfigs = append(scrapeConfigs, scs...)
+	}
+	return scrapeConfigs, nil
+}
+
+func readInputConfig(ctx context.Context, inputConfigFilename string) (PrometheusConfig, error) {
+	data, err := readInput(ctx, inputConfigFilename)
+	if err != nil {
+		return PrometheusConfig{}, errors.Wrap(err, "could not read input config")
+	}
+	if templateInput {
+		data, err = expandTemplate(data, os.Environ())
+		if err != nil {
+			return PrometheusConfig{}, errors.Wrap(err, "could not template input config")
+		}
+	}
+
+	err = checkInputConfigShape(data)
+	if err != nil {
+		return PrometheusConfig{}, errors.Wrap(err, "invalid input config")
+	}
+
+	config := PrometheusConfig{}
+	err = yaml.Unmarshal(data, &config)
+	if err != nil {
+		return PrometheusConfig{}, errors.Wrap(describeYAMLError(data, err), "could not parse input config")
+	}
+
+	seen := map[string]bool{}
+	for i, sc := range config.ScrapeConfigs {
+		if sc.JobName == "" {
+			return PrometheusConfig{}, errors.Errorf("invalid input config: scrape config %d has no job_name", i+1)
+		}
+		if seen[sc.JobName] {
+			return PrometheusConfig{}, errors.Errorf("invalid input config: job_name %v is used more than once", sc.JobName)
+		}
+		seen[sc.JobName] = true
+	}
+	return config, nil
+}
+
+// expandTemplate executes data as a text/template, with environ, as returned by os.Environ,
+// available as a map of variable name to value. Referencing an unset variable is an error.
+func expandTemplate(data []byte, environ []string) ([]byte, error) {
+	env := map[string]string{}
+	for _, kv := range environ {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) == 2 {
+			env[parts[0]] = parts[1]
+		}
+	}
+
+	tmpl, err := template.New("input").Option("missingkey=error").Parse(string(data))
+	if err != nil {
+		return nil, errors.Wrap(err, "could not parse template")
+	}
+	buf := &bytes.Buffer{}
+	err = tmpl.Execute(buf, env)
+	return buf.Bytes(), errors.Wrap(err, "could not execute template")
+}
+
+// listKeys and mapKeys are the top level input config keys checked to have the right type before
+// decoding. Decoding into PrometheusConfig would otherwise report them in terms of Go types.
+var (
+	listKeys = []string{"scrape_configs", "remote_write", "remote_read", "rule_files"}
+	mapKeys  = []string{"global", "alerting"}
+)
+
+// checkInputConfigShape checks the input config is a mapping, and that well known keys hold
+// lists or mappings as Prometheus expects
+func checkInputConfigShape(data []byte) error {
+	raw := map[string]interface{}{}
+	err := yaml.Unmarshal(data, &raw)
+	if err != nil {
+		return describeYAMLError(data, err)
+	}
+	for _, k := range listKeys {
+		if v, ok := raw[k]; ok && v != nil {
+			if _, ok := v.([]interface{}); !ok {
+				return errors.Errorf("line %d: %v must be a list", keyLine(data, k), k)
+			}
+		}
+	}
+	for _, k := range mapKeys {
+		if v, ok := raw[k]; ok && v != nil {
+			if _, ok := v.(map[interface{}]interface{}); !ok {
+				return errors.Errorf("line %d: %v must be a mapping", keyLine(data, k), k)
+			}
+		}
+	}
+	return nil
+}
+
+var yamlErrorLineRegex = regexp.MustCompile(`line (\d+):`)
+
+// describeYAMLError adds the text of each line a yaml error refers to. yaml.v2 only reports
+// lines, not columns, so the whole line is shown.
+func describeYAMLError(data []byte, err error) error {
+	lines := strings.Split(string(data), "\n")
+	msg := err.Error()
+	shown := map[int]bool{}
+	for _, m := range yamlErrorLineRegex.FindAllStringSubmatch(err.Error(), -1) {
+		n, _ := strconv.Atoi(m[1])
+		if n < 1 || n > len(lines) || shown[n] {
+			continue
+		}
+		shown[n] = true
+		msg += fmt.Sprintf("\n  %d | %v", n, strings.TrimRight(lines[n-1], "\r"))
+	}
+	return errors.New(msg)
+}
+
+// keyLine returns the line number of top level key in data, or 0 if it can't be found
+func keyLine(data []byte, key string) int {
+	for i, l := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(l, key+":") {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// isFileSource reports whether the input config source is a local file, rather than stdin (`-`)
+// or an http(s) URL
+func isFileSource(source string) bool {
+	return source != "-" && !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://")
+}
+
+// readInput reads the input config from a local file, stdin, or an http(s) URL. Stdin can only
+// be consumed once, so it is read on first use and the same data returned thereafter.
+func readInput(ctx context.Context, source string) ([]byte, error) {
+	switch {
+	case source == "-":
+		stdinOnce.Do(func() {
+			stdinData, stdinErr = ioutil.ReadAll(os.Stdin)
+		})
+		return stdinData, errors.Wrap(stdinErr, "could not read stdin")
+	case !isFileSource(source):
+		res, err := ctxhttp.Get(ctx, http.DefaultClient, source)
+		if err != nil {
+			return []byte{}, errors.Wrapf(err, "could not fetch %v", source)
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return []byte{}, errors.Errorf("could not fetch %v: unexpected status %v", source, res.Status)
+		}
+		data, err := ioutil.ReadAll(res.Body)
+		return data, errors.Wrapf(err, "could not read response from %v", source)
+	default:
+		return ioutil.ReadFile(source)
+	}
+}
+
+// Returns a channel that will is a union of time.Tick, watchFile of each of fnames and manual
+// triggers. Messages will be `true` if triggered by watchFile or a manual trigger, otherwise
+// `false`. If initial is set a `false` is sent after delay, rather than waiting for the first tick.
+func watchAndTick(ctx context.Context, fnames []string, interval, jitter time.Duration, trigger <-chan struct{}, initial bool, delay time.Duration) (<-chan bool, error) {
+	ch := make(chan bool)
+
+	// Non-file sources can't be watched and rely on the ticker alone
+	wch := make(chan struct{})
+	for _, fname := range fnames {
+		if !isFileSource(fname) {
+			continue
+		}
+		fch, err := watchFile(ctx, fname)
+		if err != nil {
+			return ch, err
+		}
+		go func() {
+			for {
+				select {
+				case <-fch:
+					wch <- struct{}{}
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	tch := tickWithJitter(ctx, interval, jitter)
+
+	go func() {
+		if initial {
+			if delay > 0 {
+				select {
+				case <-time.After(delay):
+				case <-ctx.Done():
+					return
+				}
+			}
+			ch <- false // Add an initial tick
+		}
+		for {
+			select {
+			case <-wch:
+				ch <- true
+			case <-trigger:
+				ch <- true
+			case <-tch:
+				ch <- false
+			}
+		}
+	}()
+
+	return ch, nil
+}
+
+// waitForFile blocks until fname exists, checking every interval
+func waitForFile(ctx context.Context, fname string, interval time.Duration) error {
+	for {
+		_, err := os.Stat(fname)
+		if err == nil {
+			return nil
+		}
+		if !os.IsNotExist(err) {
+			return errors.Wrapf(err, "could not stat %v", fname)
+		}
+
+		log.V(2).Infof("Waiting for %v to exist", fname)
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// tickWithJitter behaves like time.Tick, but each interval is randomly adjusted by up to ±jitter
+func tickWithJitter(ctx context.Context, interval, jitter time.Duration) <-chan time.Time {
+	if jitter <= 0 {
+		return time.Tick(interval)
+	}
+
+	ch := make(chan time.Time)
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	go func() {
+		for {
+			select {
+			case t := <-time.After(jitteredInterval(rnd, interval, jitter)):
+				ch <- t
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch
+}
+
+// jitteredInterval returns interval adjusted by a random amount in [-jitter, +jitter], never
+// returning less than zero
+func jitteredInterval(rnd *rand.Rand, interval, jitter time.Duration) time.Duration {
+	d := interval - jitter + time.Duration(rnd.Int63n(int64(2*jitter)+1))
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+func watchFile(ctx context.Context, fname string) (<-chan struct{}, error) {
+	ch := make(chan struct{})
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return ch, errors.Wrap(err, "could not create fsnotify watcher")
 	}
 
 	err = watcher.Add(fname)
@@ -351,7 +1782,10 @@ func watchFile(ctx context.Context, fname string) (<-chan struct{}, error) {
 		return ch, errors.Wrapf(err, "could not watch %v", fname)
 	}
 
-	debounce := func() {
+	// debounce swallows events for debounceDuration, returning whether fname was replaced by
+	// e, or any of the swallowed events
+	debounce := func(e fsnotify.Event) bool {
+		replaced := e.Op&(fsnotify.Remove|fsnotify.Rename) != 0
 		log.V(4).Infof("Debouncing watch event for %v", debounceDuration)
 		ctx, cancel := context.WithTimeout(ctx, debounceDuration)
 		defer cancel()
@@ -360,9 +1794,11 @@ func watchFile(ctx context.Context, fname string) (<-chan struct{}, error) {
 			select {
 			case <-ctx.Done():
 				log.V(4).Infof("Finished debounce")
-				return
+				return replaced
 			case e := <-watcher.Events:
+				watchEvents.Inc()
 				log.V(4).Infof("Event debounced: %v", e)
+				replaced = replaced || e.Op&(fsnotify.Remove|fsnotify.Rename) != 0
 			}
 		}
 	}
@@ -370,8 +1806,17 @@ func watchFile(ctx context.Context, fname string) (<-chan struct{}, error) {
 	go func() {
 		for {
 			select {
-			case <-watcher.Events:
-				debounce()
+			case e := <-watcher.Events:
+				watchEvents.Inc()
+				if debounce(e) {
+					// Files replaced by renaming over them, as editors and config management do,
+					// lose their watch, so it's added again once the new file is in place
+					err := addWatchRetrying(ctx, watcher, fname, flagBackoff(backoffMax))
+					if err != nil {
+						return
+					}
+				}
+				watchTriggers.Inc()
 				ch <- struct{}{}
 			case err := <-watcher.Errors:
 				log.Errorf("Watcher failed: %v", err)
@@ -384,87 +1829,42 @@ func watchFile(ctx context.Context, fname string) (<-chan struct{}, error) {
 	return ch, nil
 }
 
+// addWatchRetrying adds fname to watcher, retrying with b until it succeeds or ctx is done
+func addWatchRetrying(ctx context.Context, watcher *fsnotify.Watcher, fname string, b *backoff) error {
+	for {
+		err := watcher.Add(fname)
+		if err == nil {
+			return nil
+		}
+		log.Warningf("Could not watch %v, retrying: %v", fname, err)
+		err = b.Wait(ctx)
+		if err != nil {
+			return err
+		}
+	}
+}
+
 func clusterListEqual(old, new []*container.Cluster) bool {
-	oldByName := map[string]bool{}
-	newByName := map[string]bool{}
+	oldByKey := map[string]bool{}
+	newByKey := map[string]bool{}
 
 	for _, o := range old {
-		oldByName[o.Name] = true
+		oldByKey[clusterKey(o)] = true
 	}
 	for _, n := range new {
-		newByName[n.Name] = true
+		newByKey[clusterKey(n)] = true
 	}
 
 	for _, o := range old {
-		if _, ok := newByName[o.Name]; !ok {
+		if _, ok := newByKey[clusterKey(o)]; !ok {
 			return false
 		}
 	}
 	for _, n := range new {
-		if _, ok := oldByName[n.Name]; !ok {
+		if _, ok := oldByKey[clusterKey(n)]; !ok {
 			return false
 		}
 	}
 
 	return true
 }
-
-func findClusters(ctx context.Context, project string) ([]*container.Cluster, error) {
-	client, err := google.DefaultClient(ctx, container.CloudPlatformScope, compute.ComputeReadonlyScope)
-	if err != nil {
-		return []*container.Cluster{}, errors.Wrap(err, "could not create google client")
-	}
-
-	zones, err := listZones(ctx, client, project)
-	if err != nil {
-		return []*container.Cluster{}, errors.Wrap(err, "could not list zones")
-	}
-
-	clusters := []*container.Cluster{}
-	for _, z := range zones {
-		zcs, err := listClusters(ctx, client, project, z)
-		if err != nil {
-			return []*container.Cluster{}, errors.Wrapf(err, "could not list clusters in %v/%v", project, z)
-		}
-		for _, c := range zcs {
-			if c.Endpoint != "" {
-				clusters = append(clusters, c)
-			} else {
-				log.V(2).Infof("Could not get endpoint for cluster: %v", c.Name)
-			}
-		}
-	}
-	return clusters, nil
-}
-
-func listZones(ctx context.Context, client *http.Client, project string) ([]string, error) {
-	svc, err := compute.New(client)
-	if err != nil {
-		return []string{}, errors.Wrap(err, "could not create compute service")
-	}
-
-	res, err := svc.Zones.List(project).Context(ctx).Do()
-	if err != nil {
-		return []string{}, errors.Wrap(err, "could not list zones")
-	}
-
-	zones := make([]string, 0, len(res.Items))
-	for _, z := range res.Items {
-		zones = append(zones, z.Name)
-	}
-	return zones, nil
-}
-
-func listClusters(ctx context.Context, client *http.Client, project, zone string) ([]*container.Cluster, error) {
-	svc, err := container.New(client)
-	if err != nil {
-		return []*container.Cluster{}, errors.Wrap(err, "could not create container service")
-	}
-
-	res, err := svc.Projects.Zones.Clusters.List(project, zone).Context(ctx).Do()
-	if err != nil {
-		return []*container.Cluster{}, errors.Wrap(err, "could not list clusters")
-	}
-
-	return res.Clusters, nil
-}
@@ -1,9 +1,28 @@
 package main
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
+	"golang.org/x/net/context"
 	container "google.golang.org/api/container/v1"
+	"gopkg.in/yaml.v2"
 )
 
 func TestClusterListEqual(t *testing.T) {
@@ -18,6 +37,16 @@ func TestClusterListEqual(t *testing.T) {
 			new:      []*container.Cluster{},
 			expected: true,
 		},
+		{
+			old:      []*container.Cluster{{Name: "prod", SelfLink: "projects/p/zones/a/clusters/prod"}},
+			new:      []*container.Cluster{{Name: "prod", SelfLink: "projects/p/zones/a/clusters/prod"}},
+			expected: true,
+		},
+		{
+			old:      []*container.Cluster{{Name: "prod", SelfLink: "projects/p/zones/a/clusters/prod"}},
+			new:      []*container.Cluster{{Name: "prod", SelfLink: "projects/p/zones/b/clusters/prod"}},
+			expected: false,
+		},
 	}
 
 	for _, c := range cases {
@@ -32,3 +61,842 @@ func TestClusterListEqual(t *testing.T) {
 		})
 	}
 }
+
+func TestReloadHandler(t *testing.T) {
+	t.Parallel()
+
+	trigger := make(chan struct{}, 1)
+	h := reloadHandler(trigger)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/reload", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("Expected %v for GET, got %v", http.StatusMethodNotAllowed, rec.Code)
+	}
+
+	for i := 0; i < 2; i++ {
+		rec = httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/reload", nil))
+		if rec.Code != http.StatusAccepted {
+			t.Fatalf("Expected %v for POST, got %v", http.StatusAccepted, rec.Code)
+		}
+	}
+
+	if len(trigger) != 1 {
+		t.Fatalf("Expected a single pending trigger, got %v", len(trigger))
+	}
+}
+
+func TestPrometheusConfigRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	input := `global:
+  scrape_interval: 15s
+  evaluation_interval: 30s
+  external_labels:
+    region: europe-west1
+    env: prod
+scrape_configs:
+- job_name: prometheus
+  static_configs:
+  - targets: ['localhost:9090']
+remote_write:
+- url: http://remote:9201/write
+  queue_config:
+    capacity: 1000
+rule_files:
+- /etc/prometheus/rules.yml
+`
+
+	config := PrometheusConfig{}
+	if err := yaml.Unmarshal([]byte(input), &config); err != nil {
+		t.Fatalf("Could not unmarshal input: %v", err)
+	}
+	output, err := yaml.Marshal(config)
+	if err != nil {
+		t.Fatalf("Could not marshal config: %v", err)
+	}
+
+	expected := map[interface{}]interface{}{}
+	if err := yaml.Unmarshal([]byte(input), &expected); err != nil {
+		t.Fatalf("Could not unmarshal input: %v", err)
+	}
+	result := map[interface{}]interface{}{}
+	if err := yaml.Unmarshal(output, &result); err != nil {
+		t.Fatalf("Could not unmarshal output: %v", err)
+	}
+
+	if !reflect.DeepEqual(result, expected) {
+		t.Fatalf("Difference in round-tripped config\nGot: %v\nExpected: %v\n", result, expected)
+	}
+}
+
+func TestScrapeConfigRoundTripUnknownKeys(t *testing.T) {
+	t.Parallel()
+
+	input := `job_name: kubernetes_pods
+kubernetes_sd_configs:
+- api_servers: ['https://10.0.0.1']
+  role: pod
+  namespaces:
+    names: [default]
+  tls_config:
+    ca_file: /etc/ca.pem
+    server_name: kubernetes
+relabel_configs:
+- source_labels: [__meta_kubernetes_pod_name]
+  target_label: pod
+  unmodeled_option: kept
+`
+
+	config := ScrapeConfig{}
+	if err := yaml.Unmarshal([]byte(input), &config); err != nil {
+		t.Fatalf("Could not unmarshal input: %v", err)
+	}
+	output, err := yaml.Marshal(config)
+	if err != nil {
+		t.Fatalf("Could not marshal config: %v", err)
+	}
+
+	result := ScrapeConfig{}
+	if err := yaml.Unmarshal(output, &result); err != nil {
+		t.Fatalf("Could not unmarshal output: %v", err)
+	}
+
+	sd := result.KubernetesSDConfigs[0]
+	if _, ok := sd.XXX["namespaces"]; !ok {
+		t.Fatalf("Expected namespaces to be retained in kubernetes_sd_configs\nGot: %s", output)
+	}
+	if sd.TLSConfig.XXX["server_name"] != "kubernetes" {
+		t.Fatalf("Expected server_name to be retained in tls_config\nGot: %s", output)
+	}
+	if result.RelabelConfigs[0].XXX["unmodeled_option"] != "kept" {
+		t.Fatalf("Expected unmodeled_option to be retained in relabel_configs\nGot: %s", output)
+	}
+}
+
+func TestValidateCertDirs(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		outDir, referenceDir string
+		mountPoints          []string
+		valid                bool
+	}{
+		{
+			outDir:       "/etc/gke-certs",
+			referenceDir: "/etc/gke-certs/",
+			valid:        true,
+		},
+		{
+			outDir:       "/etc/gke-certs",
+			referenceDir: "/prometheus/certs",
+			mountPoints:  []string{"/", "/proc"},
+			valid:        false,
+		},
+		{
+			outDir:       "/shared/certs",
+			referenceDir: "/prometheus/certs",
+			mountPoints:  []string{"/", "/shared"},
+			valid:        true,
+		},
+		{
+			outDir:       "/sharedcerts",
+			referenceDir: "/prometheus/certs",
+			mountPoints:  []string{"/", "/shared"},
+			valid:        false,
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run("", func(t *testing.T) {
+			t.Parallel()
+
+			err := validateCertDirs(c.outDir, c.referenceDir, c.mountPoints)
+			if (err == nil) != c.valid {
+				t.Fatalf("Difference in expected result for %v -> %v\nGot: %v\nExpected valid: %v\n", c.outDir, c.referenceDir, err, c.valid)
+			}
+		})
+	}
+}
+
+func TestWriteClusterCertsSkipsFailures(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "gkesd-certs")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	valid := base64.StdEncoding.EncodeToString([]byte("cert"))
+	clusters := []*container.Cluster{
+		{
+			Name: "broken",
+			MasterAuth: &container.MasterAuth{
+				ClusterCaCertificate: valid,
+				ClientCertificate:    "not base64!",
+				ClientKey:            valid,
+			},
+		},
+		{
+			Name: "healthy",
+			MasterAuth: &container.MasterAuth{
+				ClusterCaCertificate: valid,
+				ClientCertificate:    valid,
+				ClientKey:            valid,
+			},
+		},
+		{Name: "unauthenticated"},
+	}
+
+	written, err := writeClusterCerts(dir, clusters, 2, false)
+	if err != nil {
+		t.Fatalf("Could not write certs: %v", err)
+	}
+	if len(written) != 1 || written[0].Name != "healthy" {
+		t.Fatalf("Expected only the healthy cluster to be written, got %v", written)
+	}
+	if _, err := writeClusterCerts(dir, clusters, 2, true); err == nil {
+		t.Fatalf("Expected an error for a partial write when all are required")
+	}
+	if _, err := writeClusterCerts(dir, clusters[:1], 2, false); err == nil {
+		t.Fatalf("Expected an error when no cluster could be written")
+	}
+	for _, certType := range []string{"ca", "cert", "key"} {
+		if _, err := os.Stat(certPath(dir, "healthy", certType)); err != nil {
+			t.Fatalf("Expected %v cert for healthy cluster: %v", certType, err)
+		}
+	}
+}
+
+func TestRetryUnwrittenClusters(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "gkesd-certs")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	valid := base64.StdEncoding.EncodeToString([]byte("cert"))
+	healthy := &container.Cluster{Name: "healthy", MasterAuth: &container.MasterAuth{ClusterCaCertificate: valid}}
+	broken := &container.Cluster{Name: "broken", MasterAuth: &container.MasterAuth{ClusterCaCertificate: "not base64!"}}
+
+	unwritten := unwrittenClusters([]*container.Cluster{healthy}, []*container.Cluster{broken, healthy})
+	if len(unwritten) != 1 || unwritten[0].Name != "broken" {
+		t.Fatalf("Expected only the broken cluster to be unwritten, got %v", unwritten)
+	}
+	if certsWritable(dir, unwritten, 1) {
+		t.Fatalf("Expected the broken cluster's certs to still fail")
+	}
+	if !certsWritable(dir, []*container.Cluster{healthy}, 1) {
+		t.Fatalf("Expected the healthy cluster's certs to be writable")
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("Could not read %v: %v", dir, err)
+	}
+	if len(files) != 0 {
+		t.Fatalf("Expected checking certs to leave nothing behind, got %v", files)
+	}
+}
+
+func TestWriteCABundle(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "gkesd-certs")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	clusters := []*container.Cluster{
+		{Name: "a", MasterAuth: &container.MasterAuth{ClusterCaCertificate: base64.StdEncoding.EncodeToString([]byte("ca-a"))}},
+		{Name: "b", MasterAuth: &container.MasterAuth{ClusterCaCertificate: base64.StdEncoding.EncodeToString([]byte("ca-b\n"))}},
+	}
+	if err := writeCABundle(dir, clusters); err != nil {
+		t.Fatalf("Could not write ca bundle: %v", err)
+	}
+
+	data, err := ioutil.ReadFile(caBundlePath(dir))
+	if err != nil {
+		t.Fatalf("Could not read ca bundle: %v", err)
+	}
+	if string(data) != "ca-a\nca-b\n" {
+		t.Fatalf("Difference in expected ca bundle\nGot: %q\nExpected: %q\n", data, "ca-a\nca-b\n")
+	}
+}
+
+// Not parallel, as it sets whether every cert write leaves out the ca cert
+func TestWriteClusterCertsCABundleSkipsBadCA(t *testing.T) {
+	caBundle = true
+	defer func() { caBundle = false }()
+
+	dir, err := ioutil.TempDir("", "gkesd-certs")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	clusters := []*container.Cluster{
+		{Name: "broken", MasterAuth: &container.MasterAuth{ClusterCaCertificate: "not base64!"}},
+		{Name: "healthy", MasterAuth: &container.MasterAuth{ClusterCaCertificate: base64.StdEncoding.EncodeToString([]byte("ca"))}},
+	}
+	written, err := writeClusterCerts(dir, clusters, 2, false)
+	if err != nil {
+		t.Fatalf("Could not write certs: %v", err)
+	}
+	if len(written) != 1 || written[0].Name != "healthy" {
+		t.Fatalf("Expected the cluster with a bad ca cert to be left out, got %v", written)
+	}
+	if err := writeCABundle(dir, written); err != nil {
+		t.Fatalf("Could not write ca bundle: %v", err)
+	}
+}
+
+func TestClusterCertPathTemplate(t *testing.T) {
+	t.Parallel()
+
+	cluster := &container.Cluster{
+		Name:       "prod",
+		Location:   "europe-west1",
+		SelfLink:   "https://container.googleapis.com/v1/projects/service-a/locations/europe-west1/clusters/prod",
+		MasterAuth: &container.MasterAuth{},
+	}
+
+	if p := clusterCertPath("/etc/gke-certs", nil, cluster, "ca"); p != "/etc/gke-certs/prod-ca.pem" {
+		t.Fatalf("Expected the default cert path without a template, got %v", p)
+	}
+
+	tmpl, err := parseCertFilenameTemplate("{{ .Project }}/{{ .Location }}/{{ .ClusterName }}:{{ .Type }}.crt")
+	if err != nil {
+		t.Fatalf("Could not parse template: %v", err)
+	}
+	if p := clusterCertPath("/etc/gke-certs", tmpl, cluster, "ca"); p != "/etc/gke-certs/service-a_europe-west1_prod_ca.crt" {
+		t.Fatalf("Expected a sanitized templated cert path, got %v", p)
+	}
+
+	opts := testConfigOptions()
+	opts.CertFilenameTemplate = tmpl
+	for _, sc := range clusterToScrapeConfigs(opts, map[string]Role{"pod": {}}, cluster) {
+		if sc.KubernetesSDConfigs[0].TLSConfig.CAFile != "/etc/gke-certs/service-a_europe-west1_prod_ca.crt" {
+			t.Fatalf("Expected the generated config to reference the templated path, got %+v", sc.KubernetesSDConfigs[0].TLSConfig)
+		}
+	}
+
+	if _, err := parseCertFilenameTemplate("{{ .Name }}.pem"); err == nil {
+		t.Fatalf("Expected an error for a template referencing an unknown field")
+	}
+	if _, err := parseCertFilenameTemplate("{{ .ClusterName }}.pem"); err == nil {
+		t.Fatalf("Expected an error for a template giving every cert type the same name")
+	}
+}
+
+func TestCertReferenceTemplate(t *testing.T) {
+	t.Parallel()
+
+	tmpl, err := parseCertFilenameTemplate("/mnt/{{ .Project }}/{{ .ClusterName }}/{{ .Type }}.pem")
+	if err != nil {
+		t.Fatalf("Could not parse template: %v", err)
+	}
+	opts := testConfigOptions()
+	opts.CertReferenceTemplate = tmpl
+	cluster := testCluster()
+	cluster.SelfLink = "https://container.googleapis.com/v1/projects/service-a/locations/europe-west1/clusters/prod"
+
+	scs := clusterToScrapeConfigs(opts, map[string]Role{"pod": {}}, cluster)
+	expected := TLSConfig{
+		CAFile:   "/mnt/service-a/prod/ca.pem",
+		CertFile: "/mnt/service-a/prod/cert.pem",
+		KeyFile:  "/mnt/service-a/prod/key.pem",
+	}
+	if got := scs[0].KubernetesSDConfigs[0].TLSConfig; !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Expected the templated reference paths %+v, got %+v", expected, got)
+	}
+
+	opts.CABundle = true
+	scs = clusterToScrapeConfigs(opts, map[string]Role{"pod": {}}, cluster)
+	if got := scs[0].KubernetesSDConfigs[0].TLSConfig.CAFile; got != "/mnt/service-a/prod/ca-bundle.pem" {
+		t.Fatalf("Expected the templated ca bundle reference, got %v", got)
+	}
+}
+
+func TestCertNotAfter(t *testing.T) {
+	t.Parallel()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		t.Fatalf("Could not generate key: %v", err)
+	}
+	notAfter := time.Unix(2000000000, 0).UTC()
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Unix(1000000000, 0),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(crand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Could not create certificate: %v", err)
+	}
+
+	got, err := certNotAfter(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	if err != nil {
+		t.Fatalf("Could not get expiry: %v", err)
+	}
+	if !got.Equal(notAfter) {
+		t.Fatalf("Expected expiry %v, got %v", notAfter, got)
+	}
+
+	if _, err := certNotAfter([]byte("cert")); err == nil {
+		t.Fatalf("Expected an error for non PEM data")
+	}
+}
+
+func TestCAOnlyCluster(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "gkesd-certs")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	cluster := &container.Cluster{
+		Name:     "ca-only",
+		Endpoint: "10.0.0.1",
+		MasterAuth: &container.MasterAuth{
+			ClusterCaCertificate: base64.StdEncoding.EncodeToString([]byte("ca")),
+		},
+	}
+
+	written, err := writeClusterCerts(dir, []*container.Cluster{cluster}, 1, false)
+	if err != nil {
+		t.Fatalf("Could not write certs: %v", err)
+	}
+	if len(written) != 1 {
+		t.Fatalf("Expected CA-only cluster to be written, got %v", written)
+	}
+	if _, err := os.Stat(certPath(dir, cluster.Name, "ca")); err != nil {
+		t.Fatalf("Expected ca cert to be written: %v", err)
+	}
+	for _, certType := range []string{"cert", "key"} {
+		if _, err := os.Stat(certPath(dir, cluster.Name, certType)); !os.IsNotExist(err) {
+			t.Fatalf("Expected no %v file to be written, got: %v", certType, err)
+		}
+	}
+
+	for _, sc := range clusterToScrapeConfigs(flagConfigOptions(dir), builtinRoles(), cluster) {
+		tls := sc.KubernetesSDConfigs[0].TLSConfig
+		if tls.CAFile == "" {
+			t.Fatalf("Expected ca_file to be set for %v", sc.JobName)
+		}
+		if tls.CertFile != "" || tls.KeyFile != "" {
+			t.Fatalf("Expected no cert_file or key_file for %v, got %v and %v", sc.JobName, tls.CertFile, tls.KeyFile)
+		}
+	}
+}
+
+func TestWaitForFile(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "gkesd-input")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	fname := filepath.Join(dir, "input.yml")
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		ioutil.WriteFile(fname, []byte{}, 0600)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := waitForFile(ctx, fname, 5*time.Millisecond); err != nil {
+		t.Fatalf("Expected file to be found, got: %v", err)
+	}
+}
+
+func TestReadInputConfigHTTP(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("scrape_configs:\n- job_name: prometheus\n"))
+	}))
+	defer srv.Close()
+
+	config, err := readInputConfig(context.Background(), srv.URL)
+	if err != nil {
+		t.Fatalf("Could not read input config: %v", err)
+	}
+	if len(config.ScrapeConfigs) != 1 || config.ScrapeConfigs[0].JobName != "prometheus" {
+		t.Fatalf("Unexpected input config: %+v", config)
+	}
+}
+
+func TestReadInputConfigInvalid(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		config   string
+		expected string
+	}{
+		{"global:\n  scrape_interval: 15s\nscrape_configs:\n  job_name: x\n", "line 3: scrape_configs must be a list"},
+		{"global: 15s\n", "line 1: global must be a mapping"},
+		{"scrape_configs:\n- job_name: a\n  static_configs: [\n", "3 |   static_configs: ["},
+		{"scrape_configs:\n- scrape_interval: 15s\n", "scrape config 1 has no job_name"},
+		{"scrape_configs:\n- job_name: a\n- job_name: a\n", "job_name a is used more than once"},
+	}
+
+	for _, c := range cases {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(c.config))
+		}))
+		_, err := readInputConfig(context.Background(), srv.URL)
+		srv.Close()
+		if err == nil || !strings.Contains(err.Error(), c.expected) {
+			t.Errorf("Expected error containing %q for %q, got %v", c.expected, c.config, err)
+		}
+	}
+}
+
+func TestReadExtraScrapeConfigs(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "gkesd-extra")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"b.yml":     "- job_name: b\n",
+		"a.yml":     "- job_name: a1\n- job_name: a2\n",
+		"notes.txt": "- job_name: ignored\n",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatalf("Could not write %v: %v", name, err)
+		}
+	}
+
+	scs, err := readExtraScrapeConfigs(dir)
+	if err != nil {
+		t.Fatalf("Could not read extra scrape configs: %v", err)
+	}
+	got := []string{}
+	for _, sc := range scs {
+		got = append(got, sc.JobName)
+	}
+	if !reflect.DeepEqual(got, []string{"a1", "a2", "b"}) {
+		t.Fatalf("Expected jobs a1, a2 and b in order, got %v", got)
+	}
+}
+
+func TestExpandTemplate(t *testing.T) {
+	t.Parallel()
+
+	environ := []string{"CLUSTER=prod", "REMOTE_URL=http://remote:9201/write?a=b"}
+	data, err := expandTemplate([]byte("external_labels:\n  cluster: {{ .CLUSTER }}\nurl: {{ .REMOTE_URL }}\n"), environ)
+	if err != nil {
+		t.Fatalf("Could not expand template: %v", err)
+	}
+	expected := "external_labels:\n  cluster: prod\nurl: http://remote:9201/write?a=b\n"
+	if string(data) != expected {
+		t.Fatalf("Difference in expected result\nGot: %q\nExpected: %q\n", data, expected)
+	}
+
+	if _, err := expandTemplate([]byte("{{ .UNSET }}"), environ); err == nil {
+		t.Fatalf("Expected an error for an unset variable")
+	}
+}
+
+func TestWatchAndTickStartupDelay(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	started := time.Now()
+	updates, err := watchAndTick(ctx, nil, time.Hour, 0, nil, true, 50*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Could not watch: %v", err)
+	}
+	select {
+	case force := <-updates:
+		if force {
+			t.Fatalf("Expected the initial tick not to force a sync")
+		}
+		if elapsed := time.Since(started); elapsed < 50*time.Millisecond {
+			t.Fatalf("Expected the initial tick to wait for the startup delay, came after %v", elapsed)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected an initial tick after the startup delay")
+	}
+}
+
+func TestNextGeneration(t *testing.T) {
+	t.Parallel()
+	now := time.Unix(1600000000, 0)
+	cases := []struct {
+		name     string
+		last     uint64
+		expected uint64
+	}{
+		{name: "first", last: 0, expected: 1600000000},
+		{name: "earlier", last: 1500000000, expected: 1600000000},
+		{name: "same second", last: 1600000000, expected: 1600000001},
+		{name: "ahead", last: 1600000005, expected: 1600000006},
+	}
+	for _, c := range cases {
+		if gen := nextGeneration(c.last, now); gen != c.expected {
+			t.Errorf("%v: expected generation %v, got %v", c.name, c.expected, gen)
+		}
+	}
+}
+
+func TestCoalesceUpdates(t *testing.T) {
+	t.Parallel()
+
+	updates := make(chan bool, 3)
+	updates <- false
+	updates <- true
+	updates <- false
+	if !coalesceUpdates(updates, false, 50*time.Millisecond) {
+		t.Fatalf("Expected a forced update to be coalesced into a forced sync")
+	}
+	if len(updates) != 0 {
+		t.Fatalf("Expected all updates within the interval to be coalesced, %d left", len(updates))
+	}
+
+	updates <- false
+	if coalesceUpdates(updates, false, 50*time.Millisecond) {
+		t.Fatalf("Expected only unforced updates to coalesce into an unforced sync")
+	}
+
+	close(updates)
+	started := time.Now()
+	coalesceUpdates(updates, false, time.Hour)
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Fatalf("Expected a prompt return once updates are closed, took %v", elapsed)
+	}
+}
+
+func TestJitteredInterval(t *testing.T) {
+	t.Parallel()
+
+	rnd := rand.New(rand.NewSource(1))
+	interval, jitter := 10*time.Second, 2*time.Second
+	for i := 0; i < 1000; i++ {
+		d := jitteredInterval(rnd, interval, jitter)
+		if d < interval-jitter || d > interval+jitter {
+			t.Fatalf("Interval %v outside of %v ± %v", d, interval, jitter)
+		}
+	}
+
+	if d := jitteredInterval(rnd, time.Second, time.Hour); d < 0 {
+		t.Fatalf("Expected a non-negative interval, got %v", d)
+	}
+}
+
+func TestWriteToMissingDirectories(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "gkesd-output")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	configFile := filepath.Join(dir, "config", "nested", "prometheus.yml")
+	if err := writeConfig(configFile, []byte("scrape_configs: []\n")); err != nil {
+		t.Fatalf("Could not write config: %v", err)
+	}
+	if _, err := os.Stat(configFile); err != nil {
+		t.Fatalf("Expected config to be written: %v", err)
+	}
+
+	certDir := filepath.Join(dir, "certs", "nested")
+	cluster := &container.Cluster{
+		Name: "test",
+		MasterAuth: &container.MasterAuth{
+			ClusterCaCertificate: base64.StdEncoding.EncodeToString([]byte("ca")),
+		},
+	}
+	if _, err := writeClusterCerts(certDir, []*container.Cluster{cluster}, 1, false); err != nil {
+		t.Fatalf("Could not write certs: %v", err)
+	}
+	if _, err := os.Stat(certPath(certDir, cluster.Name, "ca")); err != nil {
+		t.Fatalf("Expected ca cert to be written: %v", err)
+	}
+}
+
+func BenchmarkWriteClusterCerts(b *testing.B) {
+	dir, err := ioutil.TempDir("", "gkesd-certs")
+	if err != nil {
+		b.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	cert := base64.StdEncoding.EncodeToString(make([]byte, 2048))
+	clusters := []*container.Cluster{}
+	for i := 0; i < 100; i++ {
+		clusters = append(clusters, &container.Cluster{
+			Name: fmt.Sprintf("cluster-%d", i),
+			MasterAuth: &container.MasterAuth{
+				ClusterCaCertificate: cert,
+				ClientCertificate:    cert,
+				ClientKey:            cert,
+			},
+		})
+	}
+
+	for _, workers := range []int{1, 8} {
+		b.Run(fmt.Sprintf("workers-%d", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := writeClusterCerts(dir, clusters, workers, false); err != nil {
+					b.Fatalf("Could not write certs: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestRunCheck(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "gkesd-check")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	inputFile := filepath.Join(dir, "input.yml")
+	validRoles := filepath.Join(dir, "valid-roles.yml")
+	invalidRoles := filepath.Join(dir, "invalid-roles.yml")
+	for fname, content := range map[string]string{
+		inputFile:    "scrape_configs:\n- job_name: prometheus\n",
+		validRoles:   "pod:\n  relabel_configs:\n  - source_labels: [a]\n    action: keep\n",
+		invalidRoles: "pod:\n  relabel_configs:\n  - source_labels: [a]\n    action: explode\n",
+	} {
+		if err := ioutil.WriteFile(fname, []byte(content), 0600); err != nil {
+			t.Fatalf("Could not write %v: %v", fname, err)
+		}
+	}
+
+	if err := runCheck(context.Background(), inputFile, []string{validRoles}, dir); err != nil {
+		t.Fatalf("Expected check to pass, got: %v", err)
+	}
+	if err := runCheck(context.Background(), inputFile, []string{invalidRoles}, dir); err == nil {
+		t.Fatalf("Expected check to fail for invalid roles")
+	}
+	if err := runCheck(context.Background(), filepath.Join(dir, "missing.yml"), nil, dir); err == nil {
+		t.Fatalf("Expected check to fail for a missing input config")
+	}
+}
+
+func TestReloadAllPrometheus(t *testing.T) {
+	t.Parallel()
+
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer healthy.Close()
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	down.Close()
+
+	cases := []struct {
+		locations  []string
+		requireAll bool
+		success    bool
+	}{
+		{
+			locations: []string{healthy.URL, down.URL},
+			success:   true,
+		},
+		{
+			locations:  []string{healthy.URL, down.URL},
+			requireAll: true,
+			success:    false,
+		},
+		{
+			locations: []string{down.URL},
+			success:   false,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run("", func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+
+			err := reloadAllPrometheus(ctx, c.locations, c.requireAll)
+			if (err == nil) != c.success {
+				t.Fatalf("Difference in expected result for %v\nGot: %v\nExpected success: %v\n", c.locations, err, c.success)
+			}
+		})
+	}
+}
+
+func TestReloadPrometheusCancelled(t *testing.T) {
+	t.Parallel()
+
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	down.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	started := time.Now()
+	if err := reloadPrometheus(ctx, down.URL); err != context.Canceled {
+		t.Fatalf("Expected %v from an already cancelled context, got %v", context.Canceled, err)
+	}
+
+	// Cancelling while backing off from the failed first attempt should return without waiting
+	// out the backoff
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	if err := reloadPrometheus(ctx, down.URL); err != context.Canceled {
+		t.Fatalf("Expected %v after cancelling, got %v", context.Canceled, err)
+	}
+	if elapsed := time.Since(started); elapsed > backoffInitial/2 {
+		t.Fatalf("Expected a prompt return after cancelling, took %v", elapsed)
+	}
+}
+
+func TestReloadPrometheusErrorStatus(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "failed to reload config: couldn't load configuration", http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	err := reloadPrometheus(context.Background(), server.URL)
+	if err == nil || !strings.Contains(err.Error(), "couldn't load configuration") {
+		t.Fatalf("Expected an error with the response body for a failed reload, got %v", err)
+	}
+}
+
+// Not parallel, as it sets the reload method used by every reload
+func TestReloadPrometheusMethod(t *testing.T) {
+	defer func(method string) { reloadMethod = method }(reloadMethod)
+
+	methods := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		methods <- r.Method + " " + r.URL.Path
+	}))
+	defer server.Close()
+
+	for _, method := range []string{http.MethodPost, http.MethodPut} {
+		reloadMethod = method
+		if err := reloadPrometheus(context.Background(), server.URL); err != nil {
+			t.Fatalf("Could not reload: %v", err)
+		}
+		if got, want := <-methods, method+" /-/reload"; got != want {
+			t.Fatalf("Expected %q, got %q", want, got)
+		}
+	}
+}
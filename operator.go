@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	log "github.com/golang/glog"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+
+	container "google.golang.org/api/container/v1"
+)
+
+// operatorAPIVersion is the API version of the Prometheus Operator's ScrapeConfig resource
+const operatorAPIVersion = "monitoring.coreos.com/v1alpha1"
+
+// operatorManifestSuffix ends the name of each cluster's manifest file, so stale ones can be told
+// apart from other files in the output directory
+const operatorManifestSuffix = ".gkesd.yaml"
+
+// Keys of the cluster credentials in each cluster's secret
+const (
+	operatorCAKey       = "ca.pem"
+	operatorCertKey     = "cert.pem"
+	operatorKeyKey      = "key.pem"
+	operatorUsernameKey = "username"
+	operatorPasswordKey = "password"
+)
+
+// operatorSDRoles maps kubernetes_sd roles to the role names of the operator's ScrapeConfig. The
+// apiserver role is discovered through the endpoints of the kubernetes service.
+var operatorSDRoles = map[string]string{
+	"apiserver":     "Endpoints",
+	"endpoint":      "Endpoints",
+	"endpoints":     "Endpoints",
+	"endpointslice": "EndpointSlice",
+	"ingress":       "Ingress",
+	"node":          "Node",
+	"pod":           "Pod",
+	"service":       "Service",
+}
+
+// invalidObjectNameChars are those not allowed in the names of Kubernetes objects
+var invalidObjectNameChars = regexp.MustCompile(`[^a-z0-9.-]+`)
+
+type operatorObjectMeta struct {
+	Name      string            `yaml:"name"`
+	Namespace string            `yaml:"namespace,omitempty"`
+	Labels    map[string]string `yaml:"labels,omitempty"`
+}
+
+type operatorSecret struct {
+	APIVersion string             `yaml:"apiVersion"`
+	Kind       string             `yaml:"kind"`
+	Metadata   operatorObjectMeta `yaml:"metadata"`
+	Type       string             `yaml:"type"`
+	Data       map[string]string  `yaml:"data"`
+}
+
+type operatorScrapeConfig struct {
+	APIVersion string                   `yaml:"apiVersion"`
+	Kind       string                   `yaml:"kind"`
+	Metadata   operatorObjectMeta       `yaml:"metadata"`
+	Spec       operatorScrapeConfigSpec `yaml:"spec"`
+}
+
+type operatorScrapeConfigSpec struct {
+	JobName             string                  `yaml:"jobName"`
+	ScrapeInterval      string                  `yaml:"scrapeInterval,omitempty"`
+	HonorLabels         bool                    `yaml:"honorLabels,omitempty"`
+	HonorTimestamps     *bool                   `yaml:"honorTimestamps,omitempty"`
+	Scheme              string                  `yaml:"scheme,omitempty"`
+	MetricsPath         string                  `yaml:"metricsPath,omitempty"`
+	SampleLimit         uint                    `yaml:"sampleLimit,omitempty"`
+	TargetLimit         uint                    `yaml:"targetLimit,omitempty"`
+	ProxyURL            string                  `yaml:"proxyUrl,omitempty"`
+	ScrapeProtocols     []string                `yaml:"scrapeProtocols,omitempty"`
+	EnableHTTP2         *bool                   `yaml:"enableHTTP2,omitempty"`
+	FollowRedirects     *bool                   `yaml:"followRedirects,omitempty"`
+	KubernetesSDConfigs []operatorKubeSDConfig  `yaml:"kubernetesSDConfigs"`
+	Relabelings         []operatorRelabelConfig `yaml:"relabelings,omitempty"`
+	MetricRelabelings   []operatorRelabelConfig `yaml:"metricRelabelings,omitempty"`
+	BasicAuth           *operatorBasicAuth      `yaml:"basicAuth,omitempty"`
+	TLSConfig           *operatorTLSConfig      `yaml:"tlsConfig,omitempty"`
+}
+
+type operatorKubeSDConfig struct {
+	APIServer string             `yaml:"apiServer,omitempty"`
+	Role      string             `yaml:"role"`
+	ProxyURL  string             `yaml:"proxyUrl,omitempty"`
+	TLSConfig *operatorTLSConfig `yaml:"tlsConfig,omitempty"`
+}
+
+type operatorRelabelConfig struct {
+	SourceLabels []string `yaml:"sourceLabels,flow,omitempty"`
+	Separator    string   `yaml:"separator,omitempty"`
+	Regex        string   `yaml:"regex,omitempty"`
+	Modulus      uint64   `yaml:"modulus,omitempty"`
+	TargetLabel  string   `yaml:"targetLabel,omitempty"`
+	Replacement  string   `yaml:"replacement,omitempty"`
+	Action       string   `yaml:"action,omitempty"`
+}
+
+type operatorSecretKey struct {
+	Name string `yaml:"name"`
+	Key  string `yaml:"key"`
+}
+
+type operatorSecretOrConfigMap struct {
+	Secret operatorSecretKey `yaml:"secret"`
+}
+
+type operatorBasicAuth struct {
+	Username operatorSecretKey `yaml:"username"`
+	Password operatorSecretKey `yaml:"password"`
+}
+
+type operatorTLSConfig struct {
+	CA                 *operatorSecretOrConfigMap `yaml:"ca,omitempty"`
+	Cert               *operatorSecretOrConfigMap `yaml:"cert,omitempty"`
+	KeySecret          *operatorSecretKey         `yaml:"keySecret,omitempty"`
+	InsecureSkipVerify bool                       `yaml:"insecureSkipVerify,omitempty"`
+}
+
+// operatorObjectName returns a valid Kubernetes object name made from parts
+func operatorObjectName(parts ...string) string {
+	name := strings.ToLower(strings.Join(parts, "-"))
+	return strings.Trim(invalidObjectNameChars.ReplaceAllString(name, "-"), "-.")
+}
+
+// operatorSecretName returns the name of the secret holding a cluster's credentials
+func operatorSecretName(cluster *container.Cluster) string {
+	return operatorObjectName("gkesd", cluster.Name)
+}
+
+// clusterOperatorSecret returns the secret holding the credentials of cluster, which the
+// ScrapeConfigs of the cluster reference in place of cert files
+func clusterOperatorSecret(namespace string, cluster *container.Cluster) operatorSecret {
+	data := map[string]string{}
+	if cluster.MasterAuth != nil {
+		data[operatorCAKey] = cluster.MasterAuth.ClusterCaCertificate
+		if hasClientCert(cluster) {
+			data[operatorCertKey] = cluster.MasterAuth.ClientCertificate
+			data[operatorKeyKey] = cluster.MasterAuth.ClientKey
+		}
+		if cluster.MasterAuth.Password != "" {
+			data[operatorUsernameKey] = base64.StdEncoding.EncodeToString([]byte(cluster.MasterAuth.Username))
+			data[operatorPasswordKey] = base64.StdEncoding.EncodeToString([]byte(cluster.MasterAuth.Password))
+		}
+	}
+	return operatorSecret{
+		APIVersion: "v1",
+		Kind:       "Secret",
+		Metadata:   operatorObjectMeta{Name: operatorSecretName(cluster), Namespace: namespace},
+		Type:       "Opaque",
+		Data:       data,
+	}
+}
+
+// operatorTLS returns the operator's form of tls, referencing the credentials in secret in place
+// of the files tls names
+func operatorTLS(secret operatorSecret, tls TLSConfig) *operatorTLSConfig {
+	ref := func(key string) *operatorSecretKey {
+		if _, ok := secret.Data[key]; !ok {
+			return nil
+		}
+		return &operatorSecretKey{Name: secret.Metadata.Name, Key: key}
+	}
+	otls := &operatorTLSConfig{InsecureSkipVerify: tls.InsecureSkipVerify}
+	if k := ref(operatorCAKey); tls.CAFile != "" && k != nil {
+		otls.CA = &operatorSecretOrConfigMap{Secret: *k}
+	}
+	if k := ref(operatorCertKey); tls.CertFile != "" && k != nil {
+		otls.Cert = &operatorSecretOrConfigMap{Secret: *k}
+	}
+	if tls.KeyFile != "" {
+		otls.KeySecret = ref(operatorKeyKey)
+	}
+	if *otls == (operatorTLSConfig{}) {
+		return nil
+	}
+	return otls
+}
+
+// operatorRelabelConfigs returns the operator's form of rcs
+func operatorRelabelConfigs(rcs []RelabelConfig) []operatorRelabelConfig {
+	orcs := make([]operatorRelabelConfig, 0, len(rcs))
+	for _, rc := range rcs {
+		orcs = append(orcs, operatorRelabelConfig{
+			SourceLabels: rc.SourceLabels,
+			Separator:    rc.Seperator,
+			Regex:        rc.Regex,
+			Modulus:      rc.Modulus,
+			TargetLabel:  rc.TargetLabel,
+			Replacement:  rc.Replacement,
+			Action:       rc.Action,
+		})
+	}
+	return orcs
+}
+
+// clusterOperatorManifests returns the manifests for cluster, its secret followed by a
+// ScrapeConfig for each role. The jobs are those of the Prometheus config, with the credentials
+// referenced from the secret, so kubeconfigs and the ca bundle don't apply.
+func clusterOperatorManifests(namespace string, opts configOptions, roles map[string]Role, cluster *container.Cluster) []interface{} {
+	opts.SDKubeconfig = false
+	opts.CABundle = false
+
+	secret := clusterOperatorSecret(namespace, cluster)
+	manifests := []interface{}{secret}
+	for _, sc := range clusterToScrapeConfigs(opts, roles, cluster) {
+		sd := sc.KubernetesSDConfigs[0]
+		role, ok := operatorSDRoles[sd.Role]
+		if !ok {
+			log.Warningf("Skipping job %v, the operator has no %v role", sc.JobName, sd.Role)
+			continue
+		}
+		spec := operatorScrapeConfigSpec{
+			JobName:         sc.JobName,
+			ScrapeInterval:  sc.ScrapeInterval,
+			HonorLabels:     sc.HonorLabels,
+			HonorTimestamps: sc.HonorTimestamps,
+			Scheme:          strings.ToUpper(sc.Scheme),
+			MetricsPath:     sc.MetricsPath,
+			SampleLimit:     sc.SampleLimit,
+			TargetLimit:     sc.TargetLimit,
+			ProxyURL:        sc.ProxyURL,
+			ScrapeProtocols: sc.ScrapeProtocols,
+			EnableHTTP2:     sc.EnableHTTP2,
+			FollowRedirects: sc.FollowRedirects,
+			KubernetesSDConfigs: []operatorKubeSDConfig{
+				{
+					APIServer: sd.APIServers[0],
+					Role:      role,
+					ProxyURL:  sd.ProxyURL,
+					TLSConfig: operatorTLS(secret, sd.TLSConfig),
+				},
+			},
+			Relabelings:       operatorRelabelConfigs(sc.RelabelConfigs),
+			MetricRelabelings: operatorRelabelConfigs(sc.MetricRelabelConfigs),
+		}
+		if sd.Role == "apiserver" {
+			// Only the kubernetes service's endpoints are the API server
+			spec.Relabelings = append(operatorRelabelConfigs(apiserverEndpointsRelabelConfigs()), spec.Relabelings...)
+		}
+		if sc.TLSConfig != nil {
+			spec.TLSConfig = operatorTLS(secret, *sc.TLSConfig)
+		}
+		if _, ok := secret.Data[operatorPasswordKey]; ok && sc.BasicAuth != nil {
+			spec.BasicAuth = &operatorBasicAuth{
+				Username: operatorSecretKey{Name: secret.Metadata.Name, Key: operatorUsernameKey},
+				Password: operatorSecretKey{Name: secret.Metadata.Name, Key: operatorPasswordKey},
+			}
+		}
+		manifests = append(manifests, operatorScrapeConfig{
+			APIVersion: operatorAPIVersion,
+			Kind:       "ScrapeConfig",
+			Metadata: operatorObjectMeta{
+				Name:      operatorObjectName(sc.JobName),
+				Namespace: namespace,
+				Labels:    map[string]string{"app.kubernetes.io/managed-by": "prometheus_gke_sd"},
+			},
+			Spec: spec,
+		})
+	}
+	return manifests
+}
+
+// operatorManifestFile returns the name of the manifest file for cluster
+func operatorManifestFile(cluster *container.Cluster) string {
+	return operatorObjectName(cluster.Name) + operatorManifestSuffix
+}
+
+// writeOperatorManifests writes a file of manifests for each of clusters to dir
+func writeOperatorManifests(dir, namespace string, opts configOptions, roles map[string]Role, clusters []*container.Cluster) error {
+	for _, c := range clusters {
+		buf := &bytes.Buffer{}
+		for _, m := range clusterOperatorManifests(namespace, opts, roles, c) {
+			data, err := yaml.Marshal(m)
+			if err != nil {
+				return errors.Wrapf(err, "could not marshal manifests for cluster %v", c.Name)
+			}
+			buf.WriteString("---\n")
+			buf.Write(data)
+		}
+		fname := filepath.Join(dir, operatorManifestFile(c))
+		err := writeFileRetrying(fname, buf.Bytes(), os.FileMode(certFileMode))
+		if err != nil {
+			return errors.Wrapf(err, "could not write %v", fname)
+		}
+	}
+	return nil
+}
+
+// pruneOperatorManifests removes the manifest files in dir of clusters other than clusters
+func pruneOperatorManifests(dir string, clusters []*container.Cluster) error {
+	keep := map[string]bool{}
+	for _, c := range clusters {
+		keep[operatorManifestFile(c)] = true
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return errors.Wrapf(err, "could not read %v", dir)
+	}
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), operatorManifestSuffix) || keep[f.Name()] {
+			continue
+		}
+		log.V(2).Infof("Removing manifests of departed cluster in %v", f.Name())
+		err := os.Remove(filepath.Join(dir, f.Name()))
+		if err != nil {
+			return errors.Wrapf(err, "could not remove %v", f.Name())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	container "google.golang.org/api/container/v1"
+	"gopkg.in/yaml.v2"
+)
+
+func TestClusterOperatorManifests(t *testing.T) {
+	t.Parallel()
+
+	cluster := testCluster()
+	cluster.Name = "my-project_Prod"
+	roles := map[string]Role{"apiserver": builtinRoles()["apiserver"], "pod": builtinRoles()["pod"]}
+	manifests := clusterOperatorManifests("monitoring", testConfigOptions(), roles, cluster)
+	if len(manifests) != 3 {
+		t.Fatalf("Expected a secret and 2 ScrapeConfigs, got %+v", manifests)
+	}
+
+	secret := manifests[0].(operatorSecret)
+	if secret.Metadata.Name != "gkesd-my-project-prod" || secret.Data[operatorCAKey] != "Y2E=" || secret.Data[operatorPasswordKey] != "c2VjcmV0" {
+		t.Fatalf("Unexpected secret %+v", secret)
+	}
+
+	data, err := yaml.Marshal(manifests[1])
+	if err != nil {
+		t.Fatalf("Could not marshal manifest: %v", err)
+	}
+	for _, e := range []string{
+		"apiVersion: monitoring.coreos.com/v1alpha1\nkind: ScrapeConfig\nmetadata:\n  name: kubernetes-my-project-prod-apiserver\n  namespace: monitoring",
+		"jobName: kubernetes_my-project_Prod_apiserver",
+		"scheme: HTTPS",
+		"- apiServer: https://10.0.0.1\n    role: Endpoints\n    tlsConfig:\n      ca:\n        secret:\n          name: gkesd-my-project-prod\n          key: ca.pem",
+		"keySecret:\n        name: gkesd-my-project-prod\n        key: key.pem",
+		"- sourceLabels: [__meta_kubernetes_namespace, __meta_kubernetes_service_name, __meta_kubernetes_endpoint_port_name]",
+		"basicAuth:\n    username:\n      name: gkesd-my-project-prod\n      key: username",
+	} {
+		if !strings.Contains(string(data), e) {
+			t.Fatalf("Expected %q in output\nGot: %s", e, data)
+		}
+	}
+	if strings.Contains(string(data), "/etc/gke-certs") {
+		t.Fatalf("Expected credentials to be referenced from the secret, not files\nGot: %s", data)
+	}
+}
+
+func TestWriteOperatorManifests(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "gkesd-operator")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	dev := testCluster()
+	dev.Name = "dev"
+	other := filepath.Join(dir, "other.yaml")
+	if err := ioutil.WriteFile(other, []byte{}, 0600); err != nil {
+		t.Fatalf("Could not write %v: %v", other, err)
+	}
+	roles := map[string]Role{"pod": builtinRoles()["pod"]}
+	if err := writeOperatorManifests(dir, "", testConfigOptions(), roles, []*container.Cluster{testCluster(), dev}); err != nil {
+		t.Fatalf("Could not write manifests: %v", err)
+	}
+	if err := pruneOperatorManifests(dir, []*container.Cluster{testCluster()}); err != nil {
+		t.Fatalf("Could not prune manifests: %v", err)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "prod.gkesd.yaml"))
+	if err != nil {
+		t.Fatalf("Could not read manifests: %v", err)
+	}
+	if !strings.HasPrefix(string(data), "---\napiVersion: v1\nkind: Secret\n") || !strings.Contains(string(data), "---\napiVersion: monitoring.coreos.com/v1alpha1\n") {
+		t.Fatalf("Expected a secret then a ScrapeConfig\nGot: %s", data)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "dev.gkesd.yaml")); !os.IsNotExist(err) {
+		t.Fatalf("Expected the departed cluster's manifests to be removed, got %v", err)
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Fatalf("Expected other files to be left alone, got %v", err)
+	}
+}
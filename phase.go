@@ -0,0 +1,49 @@
+package main
+
+// Phases of the sync, which a failure is attributed to
+const (
+	phaseNone      = "none"
+	phaseDiscovery = "discovery"
+	phaseCerts     = "certs"
+	phaseConfig    = "config"
+	phaseReload    = "reload"
+	phaseUnknown   = "unknown"
+)
+
+// phaseError is an error from a phase of the sync. It reads as the error it wraps, and is
+// unwrapped by errors.Cause like any other pkg/errors wrapping.
+type phaseError struct {
+	phase string
+	err   error
+}
+
+func (e phaseError) Error() string { return e.err.Error() }
+
+func (e phaseError) Cause() error { return e.err }
+
+// inPhase attributes err to phase, returning nil if there is no error
+func inPhase(phase string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return phaseError{phase: phase, err: err}
+}
+
+// syncPhase returns the outermost phase err is attributed to in its chain of causes, none if there
+// is no error, or unknown if no phase is found
+func syncPhase(err error) string {
+	if err == nil {
+		return phaseNone
+	}
+	for err != nil {
+		if pe, ok := err.(phaseError); ok {
+			return pe.phase
+		}
+		cause, ok := err.(interface{ Cause() error })
+		if !ok {
+			break
+		}
+		err = cause.Cause()
+	}
+	return phaseUnknown
+}
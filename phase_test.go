@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestSyncPhase(t *testing.T) {
+	t.Parallel()
+
+	cause := errors.New("boom")
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"no error", nil, phaseNone},
+		{"no phase", errors.Wrap(cause, "could not"), phaseUnknown},
+		{"phase", inPhase(phaseCerts, cause), phaseCerts},
+		{"wrapped phase", errors.Wrap(inPhase(phaseReload, errors.Wrap(cause, "could not reload")), "sync failed"), phaseReload},
+		{"outermost phase", inPhase(phaseConfig, inPhase(phaseDiscovery, cause)), phaseConfig},
+	}
+	for _, tt := range tests {
+		if got := syncPhase(tt.err); got != tt.want {
+			t.Errorf("%v: expected phase %v, got %v", tt.name, tt.want, got)
+		}
+	}
+
+	err := inPhase(phaseDiscovery, errors.Wrap(cause, "could not find clusters"))
+	if err.Error() != "could not find clusters: boom" {
+		t.Errorf("Expected the phase to leave the message alone, got %q", err.Error())
+	}
+	if errors.Cause(err) != cause {
+		t.Errorf("Expected the cause to be %v, got %v", cause, errors.Cause(err))
+	}
+	if inPhase(phaseDiscovery, nil) != nil {
+		t.Errorf("Expected no error to stay nil")
+	}
+}
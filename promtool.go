@@ -0,0 +1,29 @@
+package main
+
+import (
+	"os/exec"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// findPromtool returns the path of the promtool binary at, or on the PATH as, name, or an error
+// if it's missing or not executable
+func findPromtool(name string) (string, error) {
+	path, err := exec.LookPath(name)
+	if err != nil {
+		return "", errors.Wrapf(err, "could not find promtool at %v", name)
+	}
+	return path, nil
+}
+
+// checkConfig checks the config in fname with promtool. Only the syntax is checked, as the files
+// it references are where Prometheus will read them, which may not be visible here.
+func checkConfig(ctx context.Context, promtool, fname string) error {
+	out, err := exec.CommandContext(ctx, promtool, "check", "config", "--syntax-only", fname).CombinedOutput()
+	if err != nil {
+		return errors.Wrapf(err, "promtool rejected the config: %v", strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestCheckConfig(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "gkesd-promtool")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A stand in for promtool that rejects configs mentioning "bad"
+	promtool := filepath.Join(dir, "promtool")
+	script := "#!/bin/sh\nif grep -q bad \"$4\"; then echo \"FAILED: bad config\"; exit 1; fi\n"
+	if err := ioutil.WriteFile(promtool, []byte(script), 0755); err != nil {
+		t.Fatalf("Could not write promtool: %v", err)
+	}
+	good := filepath.Join(dir, "good.yml")
+	bad := filepath.Join(dir, "bad.yml")
+	ioutil.WriteFile(good, []byte("scrape_configs: []\n"), 0600)
+	ioutil.WriteFile(bad, []byte("bad: true\n"), 0600)
+
+	path, err := findPromtool(promtool)
+	if err != nil {
+		t.Fatalf("Expected promtool to be found, got: %v", err)
+	}
+	if err := checkConfig(context.Background(), path, good); err != nil {
+		t.Fatalf("Expected the good config to pass, got: %v", err)
+	}
+	if err := checkConfig(context.Background(), path, bad); err == nil || !strings.Contains(err.Error(), "FAILED: bad config") {
+		t.Fatalf("Expected the bad config to fail with promtool's output, got: %v", err)
+	}
+
+	if _, err := findPromtool(filepath.Join(dir, "missing")); err == nil {
+		t.Fatalf("Expected a missing promtool to be an error")
+	}
+	if _, err := findPromtool(good); err == nil {
+		t.Fatalf("Expected a promtool that isn't executable to be an error")
+	}
+}
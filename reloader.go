@@ -0,0 +1,92 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	log "github.com/golang/glog"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// Reloader tells whatever reads the output config to load it again
+type Reloader interface {
+	Reload(ctx context.Context) error
+}
+
+// reloaderNames are the reloaders that can be chosen with -reloader
+var reloaderNames = []string{"prometheus-http", "signal", "none"}
+
+// newReloader returns the reloader called name, configured by flags
+func newReloader(name string) (Reloader, error) {
+	switch name {
+	case "prometheus-http":
+		return httpReloader{locations: prometheusAddresses, requireAll: reloadRequireAll}, nil
+	case "signal":
+		if reloadPIDFile == "" {
+			return nil, errors.New("the signal reloader requires -reloader.pid-file")
+		}
+		return signalReloader{pidFile: reloadPIDFile, signal: syscall.SIGHUP}, nil
+	case "none":
+		return noneReloader{}, nil
+	}
+	return nil, errors.Errorf("unknown reloader %v, must be one of %v", name, strings.Join(reloaderNames, ", "))
+}
+
+// httpReloader reloads Prometheus servers through their /-/reload endpoint
+type httpReloader struct {
+	locations  []string
+	requireAll bool
+}
+
+func (r httpReloader) Reload(ctx context.Context) error {
+	return reloadAllPrometheus(ctx, r.locations, r.requireAll)
+}
+
+// signalReloader reloads a process sharing our PID namespace by signalling it. The PID is read
+// from pidFile on every reload, so the process can restart in between.
+type signalReloader struct {
+	pidFile string
+	signal  os.Signal
+}
+
+func (r signalReloader) Reload(ctx context.Context) (err error) {
+	defer func() {
+		if err != nil {
+			reloadResult.WithLabelValues(r.pidFile, "failure").Inc()
+		} else {
+			reloadResult.WithLabelValues(r.pidFile, "success").Inc()
+		}
+	}()
+
+	data, err := ioutil.ReadFile(r.pidFile)
+	if err != nil {
+		return errors.Wrap(err, "could not read pid file")
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return errors.Wrapf(err, "invalid pid in %v", r.pidFile)
+	}
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return errors.Wrapf(err, "could not find process %v", pid)
+	}
+	err = p.Signal(r.signal)
+	if err != nil {
+		return errors.Wrapf(err, "could not signal process %v", pid)
+	}
+	log.Infof("Sent %v to process %v", r.signal, pid)
+	return nil
+}
+
+// noneReloader doesn't reload anything, for when the config is picked up without being told, such
+// as by Prometheus watching the file itself
+type noneReloader struct{}
+
+func (noneReloader) Reload(ctx context.Context) error {
+	log.V(2).Infof("Not reloading, the config is expected to be picked up when it changes")
+	return nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestNewReloader(t *testing.T) {
+	t.Parallel()
+
+	for _, name := range []string{"prometheus-http", "none"} {
+		if _, err := newReloader(name); err != nil {
+			t.Errorf("Expected reloader %v, got: %v", name, err)
+		}
+	}
+	if _, err := newReloader("carrier-pigeon"); err == nil {
+		t.Errorf("Expected an unknown reloader to be rejected")
+	}
+}
+
+func TestSignalReloader(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "gkesd-reloader")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	pidFile := filepath.Join(dir, "prometheus.pid")
+	if err := ioutil.WriteFile(pidFile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0600); err != nil {
+		t.Fatalf("Could not write pid file: %v", err)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	r := signalReloader{pidFile: pidFile, signal: syscall.SIGHUP}
+	if err := r.Reload(context.Background()); err != nil {
+		t.Fatalf("Could not reload: %v", err)
+	}
+	select {
+	case <-signals:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected a SIGHUP")
+	}
+
+	missing := signalReloader{pidFile: filepath.Join(dir, "missing.pid"), signal: syscall.SIGHUP}
+	if err := missing.Reload(context.Background()); err == nil {
+		t.Fatalf("Expected reloading with a missing pid file to fail")
+	}
+}
@@ -1,13 +1,197 @@
 package main
 
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+
+	log "github.com/golang/glog"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+
+	container "google.golang.org/api/container/v1"
+)
+
+// readOnlyKubeletPort is the unauthenticated kubelet port, disabled on recent GKE versions
+const readOnlyKubeletPort = 10255
+
+// Role describes the job generated for each cluster for a kubernetes_sd role
+type Role struct {
+	RelabelConfigs       []RelabelConfig `yaml:"relabel_configs,omitempty"`
+	MetricRelabelConfigs []RelabelConfig `yaml:"metric_relabel_configs,omitempty"`
+	HonorLabels          bool            `yaml:"honor_labels,omitempty"`
+	HonorTimestamps      *bool           `yaml:"honor_timestamps,omitempty"`
+	SampleLimit          uint            `yaml:"sample_limit,omitempty"`
+	TargetLimit          uint            `yaml:"target_limit,omitempty"`
+	ProxyURL             string          `yaml:"proxy_url,omitempty"`
+	ScrapeProtocols      []string        `yaml:"scrape_protocols,omitempty"`
+	EnableHTTP2          *bool           `yaml:"enable_http2,omitempty"`
+	FollowRedirects      *bool           `yaml:"follow_redirects,omitempty"`
+	Scheme               string          `yaml:"scheme,omitempty"`
+	MetricsPath          string          `yaml:"metrics_path,omitempty"`
+}
+
 type RelabelConfig struct {
-	SourceLabels []string `yaml:"source_labels,flow"`
-	Seperator    string   `yaml:"seperator,omitempty"`
-	Regex        string   `yaml:"regex,omitempty"`
-	Modulus      uint64   `yaml:"modulus,omitempty"`
-	TargetLabel  string   `yaml:"target_label,omitempty"`
-	Replacement  string   `yaml:"replacement,omitempty"`
-	Action       string   `yaml:"action,omitempty"`
+	SourceLabels []string               `yaml:"source_labels,flow,omitempty"`
+	Seperator    string                 `yaml:"seperator,omitempty"`
+	Regex        string                 `yaml:"regex,omitempty"`
+	Modulus      uint64                 `yaml:"modulus,omitempty"`
+	TargetLabel  string                 `yaml:"target_label,omitempty"`
+	Replacement  string                 `yaml:"replacement,omitempty"`
+	Action       string                 `yaml:"action,omitempty"`
+	XXX          map[string]interface{} `yaml:",inline"`
+}
+
+// builtinRoles returns the roles from GetRoles. Only the apiserver role sets job options, as GKE
+// masters only serve https.
+func builtinRoles() map[string]Role {
+	roles := map[string]Role{}
+	for r, rcs := range GetRoles() {
+		roles[r] = Role{RelabelConfigs: rcs}
+	}
+	roles["apiserver"] = Role{RelabelConfigs: roles["apiserver"].RelabelConfigs, Scheme: "https"}
+	return roles
+}
+
+// Policies for merging a role defined in more than one roles file
+const (
+	rolesMergeOverride = "override"
+	rolesMergeAppend   = "append"
+)
+
+// loadRoles returns the built in roles, overridden by any roles of the same name defined in
+// rolesFiles. A role defined in more than one file is merged in file order following merge,
+// either replaced by the later file or with the later file's relabel configs appended. No
+// rolesFiles returns just the built in roles.
+func loadRoles(rolesFiles []string, merge string) (map[string]Role, error) {
+	roles := builtinRoles()
+	fromFile := map[string]bool{}
+	for _, rolesFile := range rolesFiles {
+		data, err := ioutil.ReadFile(rolesFile)
+		if err != nil {
+			return roles, errors.Wrap(err, "could not read roles file")
+		}
+		fileRoles := map[string]Role{}
+		err = yaml.UnmarshalStrict(data, &fileRoles)
+		if err != nil {
+			return roles, errors.Wrapf(err, "could not parse roles file %v", rolesFile)
+		}
+
+		for r, role := range fileRoles {
+			err := validateRelabelConfigs(role.RelabelConfigs)
+			if err != nil {
+				return roles, errors.Wrapf(err, "invalid relabel configs in role %v of %v", r, rolesFile)
+			}
+			err = validateRelabelConfigs(role.MetricRelabelConfigs)
+			if err != nil {
+				return roles, errors.Wrapf(err, "invalid metric relabel configs in role %v of %v", r, rolesFile)
+			}
+			// Built in roles are always overridden, only roles from an earlier file are merged
+			if fromFile[r] && merge == rolesMergeAppend {
+				log.V(2).Infof("Appending role %v from %v", r, rolesFile)
+				roles[r] = appendRole(roles[r], role)
+				continue
+			}
+			log.V(2).Infof("Using role %v from %v", r, rolesFile)
+			roles[r] = role
+			fromFile[r] = true
+		}
+	}
+	return roles, nil
+}
+
+// appendRole returns role with the relabel configs of next appended to its own, and any other
+// options that next sets taking the place of role's
+func appendRole(role, next Role) Role {
+	merged := next
+	merged.RelabelConfigs = append(append([]RelabelConfig{}, role.RelabelConfigs...), next.RelabelConfigs...)
+	merged.MetricRelabelConfigs = append(append([]RelabelConfig{}, role.MetricRelabelConfigs...), next.MetricRelabelConfigs...)
+	merged.HonorLabels = role.HonorLabels || next.HonorLabels
+	if next.HonorTimestamps == nil {
+		merged.HonorTimestamps = role.HonorTimestamps
+	}
+	if next.SampleLimit == 0 {
+		merged.SampleLimit = role.SampleLimit
+	}
+	if next.TargetLimit == 0 {
+		merged.TargetLimit = role.TargetLimit
+	}
+	if next.ProxyURL == "" {
+		merged.ProxyURL = role.ProxyURL
+	}
+	if len(next.ScrapeProtocols) == 0 {
+		merged.ScrapeProtocols = role.ScrapeProtocols
+	}
+	if next.EnableHTTP2 == nil {
+		merged.EnableHTTP2 = role.EnableHTTP2
+	}
+	if next.FollowRedirects == nil {
+		merged.FollowRedirects = role.FollowRedirects
+	}
+	if next.Scheme == "" {
+		merged.Scheme = role.Scheme
+	}
+	if next.MetricsPath == "" {
+		merged.MetricsPath = role.MetricsPath
+	}
+	return merged
+}
+
+// validateRelabelConfigs checks relabel configs for problems that Prometheus would reject on reload
+func validateRelabelConfigs(rcs []RelabelConfig) error {
+	for i, rc := range rcs {
+		err := validateRelabelConfig(rc)
+		if err != nil {
+			return errors.Wrapf(err, "relabel config %d", i)
+		}
+	}
+	return nil
+}
+
+func validateRelabelConfig(rc RelabelConfig) error {
+	if rc.Regex != "" {
+		_, err := regexp.Compile("^(?:" + rc.Regex + ")$")
+		if err != nil {
+			return errors.Wrapf(err, "invalid regex %q", rc.Regex)
+		}
+	}
+
+	// Prometheus accepts actions in any case
+	switch strings.ToLower(rc.Action) {
+	case "", "replace":
+		if rc.TargetLabel == "" {
+			return errors.New("replace action requires target_label")
+		}
+	case "keep", "drop":
+		if len(rc.SourceLabels) == 0 {
+			return errors.Errorf("%v action requires source_labels", rc.Action)
+		}
+	case "hashmod":
+		if len(rc.SourceLabels) == 0 || rc.TargetLabel == "" || rc.Modulus == 0 {
+			return errors.New("hashmod action requires source_labels, target_label and modulus")
+		}
+	case "keepequal", "dropequal":
+		if len(rc.SourceLabels) == 0 || rc.TargetLabel == "" {
+			return errors.Errorf("%v action requires source_labels and target_label", rc.Action)
+		}
+	case "lowercase", "uppercase":
+		if rc.TargetLabel == "" {
+			return errors.Errorf("%v action requires target_label", rc.Action)
+		}
+		if rc.Replacement != "" && rc.Replacement != "$1" {
+			return errors.Errorf("%v action doesn't accept replacement", rc.Action)
+		}
+	case "labelmap":
+	case "labeldrop", "labelkeep":
+		if len(rc.SourceLabels) != 0 || rc.TargetLabel != "" {
+			return errors.Errorf("%v action doesn't accept source_labels or target_label", rc.Action)
+		}
+	default:
+		return errors.Errorf("unknown action %q", rc.Action)
+	}
+	return nil
 }
 
 func GetRoles() map[string][]RelabelConfig {
@@ -38,15 +222,6 @@ func GetRoles() map[string][]RelabelConfig {
 				Action: "labelmap",
 				Regex:  "__meta_kubernetes_node_label_(.+)",
 			},
-			{
-				SourceLabels: []string{
-					"__address__",
-				},
-				Action:      "replace",
-				Regex:       "([\\d\\.]+):([\\d]+)",
-				TargetLabel: "__address__",
-				Replacement: "$1:10255",
-			},
 		},
 		"endpoint": {
 			{
@@ -195,3 +370,292 @@ func GetRoles() map[string][]RelabelConfig {
 		},
 	}
 }
+
+// nodeAPIServerProxyRelabelConfigs returns the node role relabel configs for scraping kubelet
+// metrics through the API server proxy at endpoint, for when nodes aren't directly reachable
+func nodeAPIServerProxyRelabelConfigs(endpoint string) []RelabelConfig {
+	return []RelabelConfig{
+		{
+			Action: "labelmap",
+			Regex:  "__meta_kubernetes_node_label_(.+)",
+		},
+		{
+			SourceLabels: []string{},
+			Action:       "replace",
+			TargetLabel:  "__address__",
+			Replacement:  endpoint + ":443",
+		},
+		{
+			SourceLabels: []string{
+				"__meta_kubernetes_node_name",
+			},
+			Action:      "replace",
+			Regex:       "(.+)",
+			TargetLabel: "__metrics_path__",
+			Replacement: "/api/v1/nodes/${1}/proxy/metrics",
+		},
+	}
+}
+
+// hubGatewayRelabelConfigs returns the relabel configs scraping targets of role through the API
+// server proxy of the connect gateway, under gatewayPath. Roles the proxy can't reach, such as
+// services probed by the blackbox exporter, have none and are scraped as they are. Endpoints
+// are proxied through their pod, so those without one are dropped, and pods are proxied to over
+// http.
+func hubGatewayRelabelConfigs(role, gatewayPath string) []RelabelConfig {
+	var c []RelabelConfig
+	switch role {
+	case "apiserver":
+		c = []RelabelConfig{
+			{
+				SourceLabels: []string{
+					"__metrics_path__",
+				},
+				Action:      "replace",
+				Regex:       "(.*)",
+				TargetLabel: "__metrics_path__",
+				Replacement: gatewayPath + "${1}",
+			},
+		}
+	case "node":
+		c = []RelabelConfig{
+			{
+				SourceLabels: []string{
+					"__meta_kubernetes_node_name",
+				},
+				Action:      "replace",
+				Regex:       "(.+)",
+				TargetLabel: "__metrics_path__",
+				Replacement: gatewayPath + "/api/v1/nodes/${1}/proxy/metrics",
+			},
+		}
+	case "pod", "endpoint":
+		if role == "endpoint" {
+			c = append(c, RelabelConfig{
+				SourceLabels: []string{
+					"__meta_kubernetes_pod_name",
+				},
+				Action: "keep",
+				Regex:  "(.+)",
+			})
+		}
+		c = append(c, RelabelConfig{
+			SourceLabels: []string{
+				"__meta_kubernetes_namespace",
+				"__meta_kubernetes_pod_name",
+				"__address__",
+				"__metrics_path__",
+			},
+			Action:      "replace",
+			Regex:       "(.+);(.+);.+:(\\d+);(.*)",
+			TargetLabel: "__metrics_path__",
+			Replacement: gatewayPath + "/api/v1/namespaces/${1}/pods/${2}:${3}/proxy${4}",
+		})
+	default:
+		return nil
+	}
+	return append(c,
+		RelabelConfig{
+			SourceLabels: []string{},
+			Action:       "replace",
+			TargetLabel:  "__address__",
+			Replacement:  connectGatewayHost + ":443",
+		},
+		RelabelConfig{
+			SourceLabels: []string{},
+			Action:       "replace",
+			TargetLabel:  "__scheme__",
+			Replacement:  "https",
+		},
+	)
+}
+
+// nodeMetricsPortRelabelConfigs returns the node role relabel config scraping the kubelet on
+// port, rather than the port nodes are discovered with
+func nodeMetricsPortRelabelConfigs(port int) []RelabelConfig {
+	return []RelabelConfig{
+		{
+			SourceLabels: []string{
+				"__address__",
+			},
+			Action:      "replace",
+			Regex:       "(.+):(?:\\d+)",
+			TargetLabel: "__address__",
+			Replacement: fmt.Sprintf("${1}:%d", port),
+		},
+	}
+}
+
+// apiserverEndpointsRelabelConfigs returns a relabel config keeping only the API server's https
+// endpoint, for discovering the API server through the endpoints role
+func apiserverEndpointsRelabelConfigs() []RelabelConfig {
+	return []RelabelConfig{
+		{
+			SourceLabels: []string{
+				"__meta_kubernetes_namespace",
+				"__meta_kubernetes_service_name",
+				"__meta_kubernetes_endpoint_port_name",
+			},
+			Action: "keep",
+			Regex:  "default;kubernetes;https",
+		},
+	}
+}
+
+// clusterLabelRelabelConfigs returns a relabel config setting the cluster label to name, for
+// either targets or samples
+func clusterLabelRelabelConfigs(name string) []RelabelConfig {
+	return []RelabelConfig{
+		{
+			SourceLabels: []string{},
+			Action:       "replace",
+			TargetLabel:  "cluster",
+			Replacement:  name,
+		},
+	}
+}
+
+// nodePoolRelabelConfigs returns a relabel config keeping only nodes in one of pools
+func nodePoolRelabelConfigs(cluster *container.Cluster, pools []string) []RelabelConfig {
+	known := map[string]bool{}
+	for _, np := range cluster.NodePools {
+		known[np.Name] = true
+	}
+
+	for _, p := range pools {
+		if !known[p] {
+			log.V(2).Infof("Cluster %v has no node pool %v", cluster.Name, p)
+		}
+	}
+
+	return []RelabelConfig{
+		{
+			SourceLabels: []string{
+				"__meta_kubernetes_node_label_cloud_google_com_gke_nodepool",
+			},
+			Action: "keep",
+			Regex:  anyOfRegex(pools),
+		},
+	}
+}
+
+// nodeScrapeLabelRelabelConfigs returns relabel configs keeping only nodes labeled
+// prometheus.io/scrape=true, as the other roles do with annotations
+func nodeScrapeLabelRelabelConfigs() []RelabelConfig {
+	return []RelabelConfig{
+		{
+			SourceLabels: []string{
+				"__meta_kubernetes_node_label_prometheus_io_scrape",
+			},
+			Action: "keep",
+			Regex:  "true",
+		},
+	}
+}
+
+// podNamedPortRelabelConfigs returns relabel configs letting the pod role's prometheus.io/port
+// annotation name a container port, as well as give its number. Pods annotated with a name only
+// keep the target for the container port of that name; numbered ports are still handled by the
+// pod role. Requires Prometheus 2.41 or later for keepequal.
+func podNamedPortRelabelConfigs() []RelabelConfig {
+	return []RelabelConfig{
+		{
+			SourceLabels: []string{
+				"__meta_kubernetes_pod_container_port_name",
+			},
+			Action:      "replace",
+			TargetLabel: "__tmp_port_name",
+		},
+		{
+			SourceLabels: []string{
+				"__meta_kubernetes_pod_annotation_prometheus_io_port",
+			},
+			Action:      "replace",
+			Regex:       "(\\D.*)",
+			TargetLabel: "__tmp_port_name",
+			Replacement: "${1}",
+		},
+		{
+			SourceLabels: []string{
+				"__meta_kubernetes_pod_container_port_name",
+			},
+			Action:      "keepequal",
+			TargetLabel: "__tmp_port_name",
+		},
+	}
+}
+
+// namespaceLabel returns the meta label holding the namespace of targets of role, or an empty
+// string for roles whose targets aren't namespaced
+func namespaceLabel(role string) string {
+	switch role {
+	case "pod":
+		return "__meta_kubernetes_pod_namespace"
+	case "service", "endpoint", "endpoints":
+		return "__meta_kubernetes_service_namespace"
+	default:
+		return ""
+	}
+}
+
+// namespaceAllowlistRelabelConfigs returns a relabel config keeping only targets of role in one
+// of namespaces. Roles without namespaced targets are left unrestricted.
+func namespaceAllowlistRelabelConfigs(role string, namespaces []string) []RelabelConfig {
+	label := namespaceLabel(role)
+	if label == "" {
+		return []RelabelConfig{}
+	}
+	return []RelabelConfig{
+		{
+			SourceLabels: []string{label},
+			Action:       "keep",
+			Regex:        anyOfRegex(namespaces),
+		},
+	}
+}
+
+// namespaceDenylistRelabelConfigs returns a relabel config dropping targets of role in any of
+// namespaces. Roles without namespaced targets are left unrestricted.
+func namespaceDenylistRelabelConfigs(role string, namespaces []string) []RelabelConfig {
+	label := namespaceLabel(role)
+	if label == "" {
+		return []RelabelConfig{}
+	}
+	return []RelabelConfig{
+		{
+			SourceLabels: []string{label},
+			Action:       "drop",
+			Regex:        anyOfRegex(namespaces),
+		},
+	}
+}
+
+// anyOfRegex returns a regex matching exactly any of values
+func anyOfRegex(values []string) string {
+	quoted := make([]string, 0, len(values))
+	for _, v := range values {
+		quoted = append(quoted, regexp.QuoteMeta(v))
+	}
+	return strings.Join(quoted, "|")
+}
+
+// staticLabelRelabelConfigs returns relabel configs setting each of labels on every target, in
+// label name order so the generated config is stable
+func staticLabelRelabelConfigs(labels map[string]string) []RelabelConfig {
+	names := make([]string, 0, len(labels))
+	for n := range labels {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	rcs := make([]RelabelConfig, 0, len(names))
+	for _, n := range names {
+		rcs = append(rcs, RelabelConfig{
+			SourceLabels: []string{},
+			Action:       "replace",
+			TargetLabel:  n,
+			Replacement:  labels[n],
+		})
+	}
+	return rcs
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	container "google.golang.org/api/container/v1"
+	"gopkg.in/yaml.v2"
+)
+
+func TestNodePoolRelabelConfigs(t *testing.T) {
+	t.Parallel()
+
+	cluster := &container.Cluster{
+		Name: "test",
+		NodePools: []*container.NodePool{
+			{Name: "default-pool"},
+			{Name: "monitoring"},
+		},
+	}
+
+	rcs := nodePoolRelabelConfigs(cluster, []string{"monitoring", "high.mem"})
+	if len(rcs) != 1 || rcs[0].Action != "keep" {
+		t.Fatalf("Expected a single keep relabel config, got %+v", rcs)
+	}
+
+	re := regexp.MustCompile("^(?:" + rcs[0].Regex + ")$")
+	for pool, expected := range map[string]bool{
+		"monitoring":   true,
+		"high.mem":     true,
+		"highxmem":     false,
+		"default-pool": false,
+	} {
+		if re.MatchString(pool) != expected {
+			t.Fatalf("Expected match of %v to be %v with regex %v", pool, expected, rcs[0].Regex)
+		}
+	}
+}
+
+func TestNodeAPIServerProxyRelabelConfigs(t *testing.T) {
+	t.Parallel()
+
+	rcs := nodeAPIServerProxyRelabelConfigs("10.0.0.1")
+
+	targets := map[string]string{}
+	for _, rc := range rcs {
+		if rc.TargetLabel != "" {
+			targets[rc.TargetLabel] = rc.Replacement
+		}
+	}
+
+	if targets["__address__"] != "10.0.0.1:443" {
+		t.Fatalf("Expected __address__ to be rewritten to the API server, got %q", targets["__address__"])
+	}
+	if targets["__metrics_path__"] != "/api/v1/nodes/${1}/proxy/metrics" {
+		t.Fatalf("Expected __metrics_path__ to be rewritten to the node proxy, got %q", targets["__metrics_path__"])
+	}
+}
+
+func TestValidateRelabelConfigs(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name  string
+		rc    RelabelConfig
+		valid bool
+	}{
+		{
+			name:  "default replace",
+			rc:    RelabelConfig{SourceLabels: []string{"a"}, TargetLabel: "b"},
+			valid: true,
+		},
+		{
+			name:  "replace without target",
+			rc:    RelabelConfig{SourceLabels: []string{"a"}, Action: "replace"},
+			valid: false,
+		},
+		{
+			name:  "lowercase",
+			rc:    RelabelConfig{SourceLabels: []string{"a"}, Action: "lowercase", TargetLabel: "b"},
+			valid: true,
+		},
+		{
+			name:  "uppercase",
+			rc:    RelabelConfig{SourceLabels: []string{"a"}, Action: "uppercase", TargetLabel: "b"},
+			valid: true,
+		},
+		{
+			name:  "lowercase without target",
+			rc:    RelabelConfig{SourceLabels: []string{"a"}, Action: "lowercase"},
+			valid: false,
+		},
+		{
+			name:  "lowercase with replacement",
+			rc:    RelabelConfig{SourceLabels: []string{"a"}, Action: "lowercase", TargetLabel: "b", Replacement: "x"},
+			valid: false,
+		},
+		{
+			name:  "action in upper case",
+			rc:    RelabelConfig{SourceLabels: []string{"a"}, Action: "Keep", Regex: "true"},
+			valid: true,
+		},
+		{
+			name:  "unknown action",
+			rc:    RelabelConfig{SourceLabels: []string{"a"}, Action: "keepall"},
+			valid: false,
+		},
+		{
+			name:  "bad regex",
+			rc:    RelabelConfig{SourceLabels: []string{"a"}, Action: "keep", Regex: "(unclosed"},
+			valid: false,
+		},
+		{
+			name:  "keep without source labels",
+			rc:    RelabelConfig{Action: "keep", Regex: "true"},
+			valid: false,
+		},
+		{
+			name:  "hashmod without modulus",
+			rc:    RelabelConfig{SourceLabels: []string{"a"}, Action: "hashmod", TargetLabel: "b"},
+			valid: false,
+		},
+		{
+			name:  "hashmod",
+			rc:    RelabelConfig{SourceLabels: []string{"a"}, Action: "hashmod", TargetLabel: "b", Modulus: 4},
+			valid: true,
+		},
+		{
+			name:  "labeldrop with target",
+			rc:    RelabelConfig{Action: "labeldrop", Regex: "a", TargetLabel: "b"},
+			valid: false,
+		},
+		{
+			name:  "keepequal without target",
+			rc:    RelabelConfig{SourceLabels: []string{"a"}, Action: "keepequal"},
+			valid: false,
+		},
+		{
+			name:  "keepequal",
+			rc:    RelabelConfig{SourceLabels: []string{"a"}, Action: "keepequal", TargetLabel: "b"},
+			valid: true,
+		},
+		{
+			name:  "labelmap",
+			rc:    RelabelConfig{Action: "labelmap", Regex: "__meta_(.+)"},
+			valid: true,
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+
+			err := validateRelabelConfigs([]RelabelConfig{c.rc})
+			if (err == nil) != c.valid {
+				t.Fatalf("Difference in expected validity\nGot: %v\nExpected valid: %v\n", err, c.valid)
+			}
+		})
+	}
+}
+
+func TestBuiltinRolesValid(t *testing.T) {
+	t.Parallel()
+
+	for r, rcs := range GetRoles() {
+		if err := validateRelabelConfigs(rcs); err != nil {
+			t.Fatalf("Built in role %v is invalid: %v", r, err)
+		}
+	}
+}
+
+func TestLoadRoles(t *testing.T) {
+	t.Parallel()
+
+	f, err := ioutil.TempFile("", "gkesd-roles")
+	if err != nil {
+		t.Fatalf("Could not create temp file: %v", err)
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.WriteString(`pod:
+  honor_labels: true
+  honor_timestamps: false
+  relabel_configs:
+  - source_labels: [__meta_kubernetes_pod_annotation_prometheus_io_scrape]
+    action: keep
+    regex: "true"
+apiserver:
+  scheme: https
+  metrics_path: /metrics
+`)
+	f.Close()
+	if err != nil {
+		t.Fatalf("Could not write roles file: %v", err)
+	}
+
+	roles, err := loadRoles([]string{f.Name()}, rolesMergeOverride)
+	if err != nil {
+		t.Fatalf("Could not load roles: %v", err)
+	}
+
+	pod := roles["pod"]
+	if !pod.HonorLabels || pod.HonorTimestamps == nil || *pod.HonorTimestamps {
+		t.Fatalf("Expected honor_labels true and honor_timestamps false, got %+v", pod)
+	}
+	if len(pod.RelabelConfigs) != 1 {
+		t.Fatalf("Expected pod role to be overridden, got %+v", pod.RelabelConfigs)
+	}
+	if apiserver := roles["apiserver"]; apiserver.Scheme != "https" || apiserver.MetricsPath != "/metrics" {
+		t.Fatalf("Expected apiserver scheme and metrics_path to be set, got %+v", apiserver)
+	}
+	if _, ok := roles["node"]; !ok {
+		t.Fatalf("Expected built in node role to be kept")
+	}
+}
+
+func TestLoadRolesMerge(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "gkesd-roles")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	teamA := filepath.Join(dir, "team-a.yml")
+	teamB := filepath.Join(dir, "team-b.yml")
+	for fname, content := range map[string]string{
+		teamA: "pod:\n  sample_limit: 10\n  relabel_configs:\n  - source_labels: [a]\n    action: keep\n",
+		teamB: "pod:\n  relabel_configs:\n  - source_labels: [b]\n    action: drop\n",
+	} {
+		if err := ioutil.WriteFile(fname, []byte(content), 0600); err != nil {
+			t.Fatalf("Could not write %v: %v", fname, err)
+		}
+	}
+
+	cases := []struct {
+		merge       string
+		labels      []string
+		sampleLimit uint
+	}{
+		{rolesMergeOverride, []string{"b"}, 0},
+		{rolesMergeAppend, []string{"a", "b"}, 10},
+	}
+	for _, c := range cases {
+		roles, err := loadRoles([]string{teamA, teamB}, c.merge)
+		if err != nil {
+			t.Fatalf("Could not load roles: %v", err)
+		}
+		pod := roles["pod"]
+		labels := []string{}
+		for _, rc := range pod.RelabelConfigs {
+			labels = append(labels, rc.SourceLabels...)
+		}
+		if !reflect.DeepEqual(labels, c.labels) || pod.SampleLimit != c.sampleLimit {
+			t.Errorf("Expected %v merge to give relabel configs for %v and sample limit %v, got %+v", c.merge, c.labels, c.sampleLimit, pod)
+		}
+	}
+}
+
+func TestScrapeConfigOptionsMarshalOnlyWhenSet(t *testing.T) {
+	t.Parallel()
+
+	honorTimestamps, enableHTTP2, followRedirects := false, false, false
+	cases := []struct {
+		sc       ScrapeConfig
+		expected []string
+		absent   []string
+	}{
+		{
+			sc:     ScrapeConfig{JobName: "unset"},
+			absent: []string{"honor_labels", "honor_timestamps", "sample_limit", "target_limit", "proxy_url", "scrape_protocols", "enable_http2", "follow_redirects", "scheme", "metrics_path", "password"},
+		},
+		{
+			sc:       ScrapeConfig{JobName: "honor", HonorLabels: true, HonorTimestamps: &honorTimestamps},
+			expected: []string{"honor_labels: true", "honor_timestamps: false"},
+		},
+		{
+			sc:       ScrapeConfig{JobName: "limits", SampleLimit: 5000, TargetLimit: 100},
+			expected: []string{"sample_limit: 5000", "target_limit: 100"},
+		},
+		{
+			sc:       ScrapeConfig{JobName: "proxy", ProxyURL: "http://proxy:3128"},
+			expected: []string{"proxy_url: http://proxy:3128"},
+		},
+		{
+			sc:       ScrapeConfig{JobName: "password_file", BasicAuth: &BasicAuth{Username: "admin", PasswordFile: "/etc/gke-certs/a-password"}},
+			expected: []string{"password_file: /etc/gke-certs/a-password"},
+			absent:   []string{"password:"},
+		},
+		{
+			sc:       ScrapeConfig{JobName: "kubeconfig", KubernetesSDConfigs: []KubeSDConfig{{KubeconfigFile: "/etc/gke-certs/a-kubeconfig.yml", Role: "pod"}}},
+			expected: []string{"kubeconfig_file: /etc/gke-certs/a-kubeconfig.yml"},
+			absent:   []string{"api_servers", "tls_config"},
+		},
+		{
+			sc:       ScrapeConfig{JobName: "path", Scheme: "https", MetricsPath: "/federate"},
+			expected: []string{"scheme: https", "metrics_path: /federate"},
+		},
+		{
+			sc:       ScrapeConfig{JobName: "http2", EnableHTTP2: &enableHTTP2},
+			expected: []string{"enable_http2: false"},
+		},
+		{
+			sc:       ScrapeConfig{JobName: "redirects", FollowRedirects: &followRedirects},
+			expected: []string{"follow_redirects: false"},
+		},
+		{
+			sc:       ScrapeConfig{JobName: "protocols", ScrapeProtocols: []string{"OpenMetricsText1.0.0", "PrometheusText0.0.4"}},
+			expected: []string{"scrape_protocols:\n- OpenMetricsText1.0.0\n- PrometheusText0.0.4"},
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.sc.JobName, func(t *testing.T) {
+			t.Parallel()
+
+			data, err := yaml.Marshal(c.sc)
+			if err != nil {
+				t.Fatalf("Could not marshal scrape config: %v", err)
+			}
+			for _, e := range c.expected {
+				if !strings.Contains(string(data), e) {
+					t.Fatalf("Expected %q in output\nGot: %s", e, data)
+				}
+			}
+			for _, a := range c.absent {
+				if strings.Contains(string(data), a) {
+					t.Fatalf("Expected no %q in output\nGot: %s", a, data)
+				}
+			}
+		})
+	}
+}
+
+func TestNamespaceAllowlistRelabelConfigs(t *testing.T) {
+	t.Parallel()
+
+	if rcs := namespaceAllowlistRelabelConfigs("node", []string{"default"}); len(rcs) != 0 {
+		t.Fatalf("Expected nodes to be unrestricted, got %+v", rcs)
+	}
+
+	rcs := namespaceAllowlistRelabelConfigs("pod", []string{"default", "monitoring"})
+	if len(rcs) != 1 || rcs[0].Action != "keep" || rcs[0].SourceLabels[0] != "__meta_kubernetes_pod_namespace" {
+		t.Fatalf("Expected a keep on the pod namespace, got %+v", rcs)
+	}
+	if rcs[0].Regex != "default|monitoring" {
+		t.Fatalf("Expected regex default|monitoring, got %v", rcs[0].Regex)
+	}
+}
+
+func TestStaticLabelRelabelConfigs(t *testing.T) {
+	t.Parallel()
+
+	rcs := staticLabelRelabelConfigs(map[string]string{"team": "infra", "env": "prod"})
+	if len(rcs) != 2 {
+		t.Fatalf("Expected 2 relabel configs, got %+v", rcs)
+	}
+	if rcs[0].TargetLabel != "env" || rcs[0].Replacement != "prod" || rcs[1].TargetLabel != "team" {
+		t.Fatalf("Expected env then team to be set, got %+v", rcs)
+	}
+	if err := validateRelabelConfigs(rcs); err != nil {
+		t.Fatalf("Expected valid relabel configs, got %v", err)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	container "google.golang.org/api/container/v1"
+)
+
+// clusterSyncStatus is what is reported for each cluster in the textfile
+type clusterSyncStatus struct {
+	Name          string
+	LastSync      time.Time
+	ScrapeConfigs int
+}
+
+// updateSyncStatuses returns statuses, by cluster key, updated for a sync that wrote the config for
+// synced, out of the clusters discovered. Discovered clusters left out of the sync keep the time
+// they were last synced, and clusters no longer discovered are dropped.
+func updateSyncStatuses(statuses map[string]clusterSyncStatus, discovered, synced []*container.Cluster, opts configOptions, roles map[string]Role, now time.Time) map[string]clusterSyncStatus {
+	updated := map[string]clusterSyncStatus{}
+	for _, c := range discovered {
+		if s, ok := statuses[clusterKey(c)]; ok {
+			updated[clusterKey(c)] = s
+		}
+	}
+	for _, c := range synced {
+		updated[clusterKey(c)] = clusterSyncStatus{
+			Name:          c.Name,
+			LastSync:      now,
+			ScrapeConfigs: len(clusterToScrapeConfigs(opts, roles, c)),
+		}
+	}
+	return updated
+}
+
+// statusesByName sorts statuses by cluster name
+type statusesByName []clusterSyncStatus
+
+func (s statusesByName) Len() int           { return len(s) }
+func (s statusesByName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+func (s statusesByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// formatTextfile renders statuses in the node_exporter textfile collector format, in cluster
+// name order
+func formatTextfile(statuses map[string]clusterSyncStatus) []byte {
+	sorted := make(statusesByName, 0, len(statuses))
+	for _, s := range statuses {
+		sorted = append(sorted, s)
+	}
+	sort.Sort(sorted)
+
+	buf := &bytes.Buffer{}
+	fmt.Fprintln(buf, "# HELP gkesd_cluster_last_sync Unix time the cluster was last successfully synced to the Prometheus config")
+	fmt.Fprintln(buf, "# TYPE gkesd_cluster_last_sync gauge")
+	for _, s := range sorted {
+		fmt.Fprintf(buf, "gkesd_cluster_last_sync{cluster=%q} %d\n", s.Name, s.LastSync.Unix())
+	}
+	fmt.Fprintln(buf, "# HELP gkesd_cluster_scrape_configs Number of scrape configs generated for the cluster")
+	fmt.Fprintln(buf, "# TYPE gkesd_cluster_scrape_configs gauge")
+	for _, s := range sorted {
+		fmt.Fprintf(buf, "gkesd_cluster_scrape_configs{cluster=%q} %d\n", s.Name, s.ScrapeConfigs)
+	}
+	return buf.Bytes()
+}
+
+// writeTextfile writes statuses to fname. The textfile collector may read at any time, so the
+// file is written alongside and renamed into place.
+func writeTextfile(fname string, statuses map[string]clusterSyncStatus) error {
+	err := os.MkdirAll(filepath.Dir(fname), os.FileMode(dirMode))
+	if err != nil {
+		return errors.Wrap(err, "could not create textfile directory")
+	}
+	tmp := fname + ".tmp"
+	err = ioutil.WriteFile(tmp, formatTextfile(statuses), 0644)
+	if err != nil {
+		return errors.Wrapf(err, "could not write %v", tmp)
+	}
+	return errors.Wrapf(os.Rename(tmp, fname), "could not rename %v to %v", tmp, fname)
+}
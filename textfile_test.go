@@ -0,0 +1,82 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	container "google.golang.org/api/container/v1"
+)
+
+func TestWriteTextfile(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "gkesd-textfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fname := filepath.Join(dir, "collector", "gkesd.prom")
+	statuses := map[string]clusterSyncStatus{
+		"projects/p/zones/z/clusters/b": {Name: "b", LastSync: time.Unix(1500000000, 0), ScrapeConfigs: 3},
+		"projects/p/zones/z/clusters/a": {Name: "a", LastSync: time.Unix(1600000000, 0), ScrapeConfigs: 5},
+	}
+	if err := writeTextfile(fname, statuses); err != nil {
+		t.Fatalf("Could not write textfile: %v", err)
+	}
+
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `# HELP gkesd_cluster_last_sync Unix time the cluster was last successfully synced to the Prometheus config
+# TYPE gkesd_cluster_last_sync gauge
+gkesd_cluster_last_sync{cluster="a"} 1600000000
+gkesd_cluster_last_sync{cluster="b"} 1500000000
+# HELP gkesd_cluster_scrape_configs Number of scrape configs generated for the cluster
+# TYPE gkesd_cluster_scrape_configs gauge
+gkesd_cluster_scrape_configs{cluster="a"} 5
+gkesd_cluster_scrape_configs{cluster="b"} 3
+`
+	if string(data) != expected {
+		t.Fatalf("Difference in expected textfile\nGot:\n%v\nExpected:\n%v\n", string(data), expected)
+	}
+	if _, err := os.Stat(fname + ".tmp"); !os.IsNotExist(err) {
+		t.Fatalf("Expected the temporary file to have been renamed, got %v", err)
+	}
+}
+
+func TestUpdateSyncStatuses(t *testing.T) {
+	t.Parallel()
+
+	before := time.Unix(1500000000, 0)
+	now := time.Unix(1600000000, 0)
+	statuses := map[string]clusterSyncStatus{
+		"projects/p/zones/a/clusters/failing":  {Name: "a_failing", LastSync: before, ScrapeConfigs: 1},
+		"projects/p/zones/a/clusters/departed": {Name: "a_departed", LastSync: before, ScrapeConfigs: 1},
+		"projects/p/zones/a/clusters/prod":     {Name: "a_prod", LastSync: before, ScrapeConfigs: 1},
+	}
+	synced := []*container.Cluster{
+		{Name: "a_prod", SelfLink: "projects/p/zones/a/clusters/prod", MasterAuth: &container.MasterAuth{}},
+		{Name: "b_prod", SelfLink: "projects/p/zones/b/clusters/prod", MasterAuth: &container.MasterAuth{}},
+	}
+	discovered := append([]*container.Cluster{
+		{Name: "a_failing", SelfLink: "projects/p/zones/a/clusters/failing"},
+		{Name: "a_new-failing", SelfLink: "projects/p/zones/a/clusters/new-failing"},
+	}, synced...)
+	roles := map[string]Role{"pod": builtinRoles()["pod"], "node": builtinRoles()["node"]}
+
+	updated := updateSyncStatuses(statuses, discovered, synced, testConfigOptions(), roles, now)
+	expected := map[string]clusterSyncStatus{
+		"projects/p/zones/a/clusters/failing": {Name: "a_failing", LastSync: before, ScrapeConfigs: 1},
+		"projects/p/zones/a/clusters/prod":    {Name: "a_prod", LastSync: now, ScrapeConfigs: 2},
+		"projects/p/zones/b/clusters/prod":    {Name: "b_prod", LastSync: now, ScrapeConfigs: 2},
+	}
+	if !reflect.DeepEqual(updated, expected) {
+		t.Fatalf("Expected statuses %+v, got %+v", expected, updated)
+	}
+}
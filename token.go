@@ -0,0 +1,107 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/golang/glog"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// tokenSourceFunc returns a new source of access tokens
+type tokenSourceFunc func(ctx context.Context) (oauth2.TokenSource, error)
+
+// newGCPTokenSource returns a source of access tokens for the application default credentials.
+// Sources cache their token until shortly before it expires, so a new one is needed to refresh
+// a token any earlier.
+func newGCPTokenSource(ctx context.Context) (oauth2.TokenSource, error) {
+	ts, err := google.DefaultTokenSource(ctx, "https://www.googleapis.com/auth/cloud-platform")
+	return ts, errors.Wrap(err, "could not find default credentials")
+}
+
+// writeToken writes the access token of token to fname. Prometheus reads the file at each
+// scrape, so it's written alongside and renamed into place.
+func writeToken(token *oauth2.Token, fname string) error {
+	err := os.MkdirAll(filepath.Dir(fname), os.FileMode(dirMode))
+	if err != nil {
+		return errors.Wrap(err, "could not create token directory")
+	}
+	tmp := fname + ".tmp"
+	err = writeFileRetrying(tmp, []byte(token.AccessToken), os.FileMode(certFileMode))
+	if err != nil {
+		return errors.Wrapf(err, "could not write %v", tmp)
+	}
+	return errors.Wrapf(os.Rename(tmp, fname), "could not rename %v to %v", tmp, fname)
+}
+
+// tokenRefreshDelay returns how long after now a token expiring at expiry should be refreshed,
+// which is margin before it expires. Tokens without an expiry are refreshed after margin.
+func tokenRefreshDelay(expiry time.Time, margin time.Duration, now time.Time) time.Duration {
+	if expiry.IsZero() {
+		return margin
+	}
+	d := expiry.Sub(now) - margin
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+// refreshToken gets a token from a new source and writes it to fname, unless it's the token
+// last written, returning the token and whether it was written
+func refreshToken(ctx context.Context, newSource tokenSourceFunc, fname, last string) (*oauth2.Token, bool, error) {
+	ts, err := newSource(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	token, err := ts.Token()
+	if err != nil {
+		return nil, false, errors.Wrap(err, "could not get access token")
+	}
+	if token.AccessToken == last {
+		return token, false, nil
+	}
+	return token, true, writeToken(token, fname)
+}
+
+// refreshTokenFile keeps fname holding a current access token until ctx is done, rewriting it
+// margin before each token expires, independently of syncs. Failures, and being handed the same
+// token again, are retried with backoff while the previous token may still be valid.
+func refreshTokenFile(ctx context.Context, newSource tokenSourceFunc, fname string, margin time.Duration) {
+	b := flagBackoff(margin)
+	last := ""
+	for {
+		var delay time.Duration
+		token, written, err := refreshToken(ctx, newSource, fname, last)
+		switch {
+		case err != nil:
+			tokenRefreshes.WithLabelValues("error").Inc()
+			delay = b.Next()
+			log.Errorf("Failed to refresh bearer token, retrying in %v: %v", delay, err)
+		case !written:
+			delay = b.Next()
+			log.V(2).Infof("Bearer token hasn't been renewed yet, retrying in %v", delay)
+		default:
+			last = token.AccessToken
+			tokenRefreshes.WithLabelValues("success").Inc()
+			tokenExpiry.Set(float64(token.Expiry.Unix()))
+			b = flagBackoff(margin)
+			delay = tokenRefreshDelay(token.Expiry, margin, time.Now())
+			if delay == 0 {
+				// Already within the margin, so retry until a later token is handed out
+				delay = b.Next()
+			}
+			log.V(2).Infof("Wrote bearer token to %v, refreshing in %v", fname, delay)
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
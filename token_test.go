@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+)
+
+func TestTokenRefreshDelay(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		expiry time.Time
+		want   time.Duration
+	}{
+		{"before margin", now.Add(time.Hour), 55 * time.Minute},
+		{"within margin", now.Add(time.Minute), 0},
+		{"expired", now.Add(-time.Minute), 0},
+		{"no expiry", time.Time{}, 5 * time.Minute},
+	}
+
+	for _, tt := range tests {
+		if got := tokenRefreshDelay(tt.expiry, 5*time.Minute, now); got != tt.want {
+			t.Fatalf("%v: expected %v, got %v", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestRefreshToken(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "gkesd-token")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	fname := filepath.Join(dir, "hub", "token")
+	tokens := []string{"ya29.first", "ya29.first", "ya29.second"}
+	sources := 0
+	newSource := func(ctx context.Context) (oauth2.TokenSource, error) {
+		ts := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: tokens[sources]})
+		sources++
+		return ts, nil
+	}
+
+	last := ""
+	for i, expected := range []bool{true, false, true} {
+		token, written, err := refreshToken(context.Background(), newSource, fname, last)
+		if err != nil {
+			t.Fatalf("Could not refresh token: %v", err)
+		}
+		if written != expected {
+			t.Fatalf("Refresh %v: expected written to be %v for %v after %v", i, expected, token.AccessToken, last)
+		}
+		last = token.AccessToken
+	}
+	if sources != 3 {
+		t.Fatalf("Expected a new token source for each refresh, got %v", sources)
+	}
+
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		t.Fatalf("Could not read token: %v", err)
+	}
+	if string(data) != "ya29.second" {
+		t.Fatalf("Expected the latest access token, got %q", data)
+	}
+	if _, err := os.Stat(fname + ".tmp"); !os.IsNotExist(err) {
+		t.Fatalf("Expected the temporary file to be renamed, got %v", err)
+	}
+}
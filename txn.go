@@ -0,0 +1,153 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	log "github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+// stagePrefix names the hidden directories that writes are staged in, within the directory
+// they're destined for so they can be renamed into place
+const stagePrefix = ".gkesd-stage-"
+
+// writeTxn stages the files written during a sync so they're only put in place together, and
+// can be put back as they were if a later step fails. Files are staged in a directory within
+// their destination, so each is promoted with a rename. Promotion is a series of renames rather
+// than an atomic swap, so a reader may see some files promoted and others not until it's done.
+type writeTxn struct {
+	// stages maps each destination directory to its staging directory
+	stages map[string]string
+	// promoted are the files put in place, in order, for rolling back
+	promoted []promotedFile
+}
+
+type promotedFile struct {
+	path   string
+	backup string // empty if there was no previous file
+}
+
+func newWriteTxn() *writeTxn {
+	return &writeTxn{stages: map[string]string{}}
+}
+
+// Dir returns the staging directory for files destined for dir, creating both if needed
+func (t *writeTxn) Dir(dir string) (string, error) {
+	if stage, ok := t.stages[dir]; ok {
+		return stage, nil
+	}
+	err := os.MkdirAll(dir, os.FileMode(dirMode))
+	if err != nil {
+		return "", errors.Wrapf(err, "could not create %v", dir)
+	}
+	stage, err := ioutil.TempDir(dir, stagePrefix)
+	if err != nil {
+		return "", errors.Wrapf(err, "could not create staging directory in %v", dir)
+	}
+	t.stages[dir] = stage
+	return stage, nil
+}
+
+// Promote renames every staged file into place, one at a time, keeping any file it replaces for
+// Rollback. If a file can't be put in place, those already promoted are rolled back.
+func (t *writeTxn) Promote() error {
+	for dir, stage := range t.stages {
+		backupDir := filepath.Join(stage, ".backup")
+		err := os.Mkdir(backupDir, 0700)
+		if err != nil {
+			return t.abort(errors.Wrapf(err, "could not create backup directory in %v", stage))
+		}
+
+		files, err := ioutil.ReadDir(stage)
+		if err != nil {
+			return t.abort(errors.Wrapf(err, "could not read staging directory %v", stage))
+		}
+		for _, f := range files {
+			if f.IsDir() {
+				continue
+			}
+			err = t.promote(filepath.Join(stage, f.Name()), filepath.Join(dir, f.Name()), filepath.Join(backupDir, f.Name()))
+			if err != nil {
+				return t.abort(err)
+			}
+		}
+	}
+	return nil
+}
+
+func (t *writeTxn) promote(staged, path, backup string) error {
+	err := os.Rename(path, backup)
+	switch {
+	case os.IsNotExist(err):
+		backup = ""
+	case err != nil:
+		return errors.Wrapf(err, "could not back up %v", path)
+	}
+
+	err = os.Rename(staged, path)
+	if err != nil {
+		if backup != "" {
+			os.Rename(backup, path)
+		}
+		return errors.Wrapf(err, "could not promote %v", path)
+	}
+	t.promoted = append(t.promoted, promotedFile{path: path, backup: backup})
+	return nil
+}
+
+func (t *writeTxn) abort(err error) error {
+	rerr := t.Rollback()
+	if rerr != nil {
+		log.Errorf("Could not roll back writes: %v", rerr)
+	}
+	return err
+}
+
+// Rollback puts back the files replaced by Promote, and removes those that didn't exist before
+func (t *writeTxn) Rollback() error {
+	var firstErr error
+	for i := len(t.promoted) - 1; i >= 0; i-- {
+		p := t.promoted[i]
+		var err error
+		if p.backup != "" {
+			err = os.Rename(p.backup, p.path)
+		} else {
+			err = os.Remove(p.path)
+		}
+		if err != nil && firstErr == nil {
+			firstErr = errors.Wrapf(err, "could not restore %v", p.path)
+		}
+	}
+	t.promoted = nil
+	return firstErr
+}
+
+// removeStaleStages removes staging directories left in dir by a sync that didn't finish, such as
+// when the process was killed part way through. Any files that sync had already promoted are left
+// in place, as there's no telling which they were.
+func removeStaleStages(dir string) error {
+	stages, err := filepath.Glob(filepath.Join(dir, stagePrefix+"*"))
+	if err != nil {
+		return errors.Wrapf(err, "could not list staging directories in %v", dir)
+	}
+	for _, stage := range stages {
+		log.Warningf("Removing staging directory %v left by an unfinished sync", stage)
+		err = os.RemoveAll(stage)
+		if err != nil {
+			return errors.Wrapf(err, "could not remove staging directory %v", stage)
+		}
+	}
+	return nil
+}
+
+// Cleanup removes the staging directories, along with any staged files and backups left in them
+func (t *writeTxn) Cleanup() {
+	for _, stage := range t.stages {
+		err := os.RemoveAll(stage)
+		if err != nil {
+			log.Warningf("Could not remove staging directory %v: %v", stage, err)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteTxn(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "gkesd-txn")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	certDir := filepath.Join(dir, "certs")
+	existing := filepath.Join(certDir, "a-ca.pem")
+	added := filepath.Join(certDir, "b-ca.pem")
+	if err := os.MkdirAll(certDir, 0755); err != nil {
+		t.Fatalf("Could not create cert dir: %v", err)
+	}
+	if err := ioutil.WriteFile(existing, []byte("old"), 0600); err != nil {
+		t.Fatalf("Could not write cert: %v", err)
+	}
+
+	txn := newWriteTxn()
+	stage, err := txn.Dir(certDir)
+	if err != nil {
+		t.Fatalf("Could not stage: %v", err)
+	}
+	if again, _ := txn.Dir(certDir); again != stage {
+		t.Fatalf("Expected the same staging directory for %v, got %v and %v", certDir, stage, again)
+	}
+	for _, f := range []string{"a-ca.pem", "b-ca.pem"} {
+		if err := ioutil.WriteFile(filepath.Join(stage, f), []byte("new"), 0600); err != nil {
+			t.Fatalf("Could not write staged cert: %v", err)
+		}
+	}
+
+	if data, _ := ioutil.ReadFile(existing); string(data) != "old" {
+		t.Fatalf("Expected staged writes to leave %v alone until promoted, got %q", existing, data)
+	}
+
+	if err := txn.Promote(); err != nil {
+		t.Fatalf("Could not promote: %v", err)
+	}
+	for _, f := range []string{existing, added} {
+		if data, _ := ioutil.ReadFile(f); string(data) != "new" {
+			t.Fatalf("Expected %v to be promoted, got %q", f, data)
+		}
+	}
+
+	if err := txn.Rollback(); err != nil {
+		t.Fatalf("Could not roll back: %v", err)
+	}
+	if data, _ := ioutil.ReadFile(existing); string(data) != "old" {
+		t.Fatalf("Expected %v to be restored, got %q", existing, data)
+	}
+	if _, err := os.Stat(added); !os.IsNotExist(err) {
+		t.Fatalf("Expected %v to be removed, got %v", added, err)
+	}
+
+	txn.Cleanup()
+	files, err := ioutil.ReadDir(certDir)
+	if err != nil {
+		t.Fatalf("Could not read cert dir: %v", err)
+	}
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), stagePrefix) {
+			t.Fatalf("Expected staging directory %v to be removed", f.Name())
+		}
+	}
+}
+
+func TestRemoveStaleStages(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "gkesd-txn")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	stale := filepath.Join(dir, stagePrefix+"123", ".backup")
+	if err := os.MkdirAll(stale, 0755); err != nil {
+		t.Fatalf("Could not create staging dir: %v", err)
+	}
+	kept := filepath.Join(dir, "a-ca.pem")
+	if err := ioutil.WriteFile(kept, []byte("cert"), 0600); err != nil {
+		t.Fatalf("Could not write cert: %v", err)
+	}
+
+	if err := removeStaleStages(dir); err != nil {
+		t.Fatalf("Could not remove staging dirs: %v", err)
+	}
+	if _, err := os.Stat(filepath.Dir(stale)); !os.IsNotExist(err) {
+		t.Fatalf("Expected the staging dir to have been removed, got %v", err)
+	}
+	if _, err := os.Stat(kept); err != nil {
+		t.Fatalf("Expected %v to have been kept, got %v", kept, err)
+	}
+	if err := removeStaleStages(filepath.Join(dir, "missing")); err != nil {
+		t.Fatalf("Expected no error for a missing dir, got %v", err)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestRequireClientCert(t *testing.T) {
+	t.Parallel()
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	verified := &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{}}}}
+
+	cases := []struct {
+		name     string
+		required bool
+		tls      *tls.ConnectionState
+		expected int
+	}{
+		{name: "not required", expected: http.StatusOK},
+		{name: "plaintext", required: true, expected: http.StatusForbidden},
+		{name: "no client cert", required: true, tls: &tls.ConnectionState{}, expected: http.StatusForbidden},
+		{name: "verified", required: true, tls: verified, expected: http.StatusOK},
+	}
+
+	for _, c := range cases {
+		r := httptest.NewRequest("POST", "/reload", nil)
+		r.TLS = c.tls
+		w := httptest.NewRecorder()
+		requireClientCert(c.required, ok).ServeHTTP(w, r)
+		if w.Code != c.expected {
+			t.Errorf("%v: expected status %v, got %v", c.name, c.expected, w.Code)
+		}
+	}
+}
+
+func TestWebTLSConfigInvalidCA(t *testing.T) {
+	t.Parallel()
+
+	f, err := ioutil.TempFile("", "gkesd-client-ca")
+	if err != nil {
+		t.Fatalf("Could not create temp file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("not a certificate")
+	f.Close()
+
+	if _, err := webTLSConfig(f.Name()); err == nil {
+		t.Fatalf("Expected an error for a client ca file without certificates")
+	}
+	if config, err := webTLSConfig(""); err != nil || config.ClientCAs != nil {
+		t.Fatalf("Expected no client verification without a client ca file, got %+v, %v", config, err)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+	"time"
+
+	log "github.com/golang/glog"
+	"golang.org/x/net/context"
+)
+
+// writeAttempts is how many times a write failing with a transient error is tried
+const writeAttempts = 4
+
+// transientWriteErrnos are the errors that writes to networked volumes, such as NFS, fail with
+// intermittently, and that are worth retrying. Anything else, such as ENOSPC or EACCES, won't
+// go away by itself.
+var transientWriteErrnos = map[syscall.Errno]bool{
+	syscall.EAGAIN: true,
+	syscall.EINTR:  true,
+	syscall.EBUSY:  true,
+	syscall.ESTALE: true,
+}
+
+// isTransientWriteError returns whether err is a write error worth retrying
+func isTransientWriteError(err error) bool {
+	if pe, ok := err.(*os.PathError); ok {
+		err = pe.Err
+	}
+	errno, ok := err.(syscall.Errno)
+	return ok && transientWriteErrnos[errno]
+}
+
+// retryTransientWrite calls write until it succeeds, fails with an error that isn't transient,
+// or has been tried writeAttempts times, backing off between attempts
+func retryTransientWrite(fname string, b *backoff, write func() error) error {
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = write()
+		if err == nil || !isTransientWriteError(err) || attempt == writeAttempts {
+			return err
+		}
+		log.Warningf("Failed to write %v, retrying: %v", fname, err)
+		b.Wait(context.Background())
+	}
+}
+
+// writeFileRetrying is ioutil.WriteFile, retried on transient errors
+func writeFileRetrying(fname string, data []byte, perm os.FileMode) error {
+	b := newBackoff(100*time.Millisecond, 2, time.Second, backoffJitter)
+	return retryTransientWrite(fname, b, func() error {
+		return ioutil.WriteFile(fname, data, perm)
+	})
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestRetryTransientWrite(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name  string
+		errs  []error
+		calls int
+		fails bool
+	}{
+		{
+			name:  "success",
+			errs:  []error{nil},
+			calls: 1,
+		},
+		{
+			name:  "transient",
+			errs:  []error{&os.PathError{Op: "open", Path: "f", Err: syscall.ESTALE}, syscall.EAGAIN, nil},
+			calls: 3,
+		},
+		{
+			name:  "no space",
+			errs:  []error{&os.PathError{Op: "write", Path: "f", Err: syscall.ENOSPC}, nil},
+			calls: 1,
+			fails: true,
+		},
+		{
+			name:  "permission",
+			errs:  []error{&os.PathError{Op: "open", Path: "f", Err: syscall.EACCES}, nil},
+			calls: 1,
+			fails: true,
+		},
+		{
+			name:  "other",
+			errs:  []error{errors.New("boom"), nil},
+			calls: 1,
+			fails: true,
+		},
+		{
+			name:  "persistently transient",
+			errs:  []error{syscall.EAGAIN, syscall.EAGAIN, syscall.EAGAIN, syscall.EAGAIN, nil},
+			calls: writeAttempts,
+			fails: true,
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+
+			calls := 0
+			b := newBackoff(time.Millisecond, 1, time.Millisecond, 0)
+			err := retryTransientWrite("f", b, func() error {
+				calls++
+				return c.errs[calls-1]
+			})
+			if (err != nil) != c.fails {
+				t.Fatalf("Expected failure %v, got %v", c.fails, err)
+			}
+			if calls != c.calls {
+				t.Fatalf("Expected %v attempts, got %v", c.calls, calls)
+			}
+		})
+	}
+}